@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// This file contains appointments, for project demos or grade disputes,
+// which don't suit a first come, first served line. TAs publish blocks of
+// time they are available in, students book one of the slots these blocks
+// are split into, and when the slot starts, the booking enters the queue
+// ahead of everybody who walked in.
+
+// An AvailabilityBlock is a time a TA is available for appointments. It is
+// split into slots of Config.AppointmentMinutes.
+type AvailabilityBlock struct {
+	ID       uint
+	TA       string // Username of the TA.
+	Start    time.Time
+	End      time.Time
+	Category string // What the appointments are for, see categories.go. Empty for anything.
+}
+
+// A Slot is a part of an availability block students can book.
+type Slot struct {
+	BlockID  uint
+	TA       string
+	Category string
+	Start    time.Time
+	End      time.Time
+}
+
+// Key identifies the slot in forms.
+func (s Slot) Key() string {
+	return fmt.Sprintf("%d-%d", s.BlockID, s.Start.Unix())
+}
+
+// A Booking is a slot a student booked. The student fills in CSid, Name,
+// TaskInfo, Email (if they want a confirmation) and Locale, like when joining
+// the queue.
+type Booking struct {
+	ID        uint
+	BlockID   uint
+	TA        string
+	Category  string
+	Start     time.Time
+	End       time.Time
+	CSid      string
+	Name      string
+	TaskInfo  string
+	Email     string
+	Locale    string
+	BookedAt  time.Time
+	Cancelled bool
+	TicketID  uint // The ticket the booking entered the queue with, once its slot started.
+
+	// Set by the retention policy, see anonymiseBooking.
+	Anonymised bool
+}
+
+// Errors returned by BookSlot.
+var (
+	ErrSlotTaken    = errors.New("the slot was booked by somebody else, or is gone")
+	ErrBookingLimit = errors.New("the student booked MaxBookingsPerWeek appointments in the last 7 days")
+	ErrDoubleBooked = errors.New("the student has another appointment at that time")
+)
+
+// How appointment times are shown to students and TAs, in the server's time
+// zone.
+const appointmentTimeLayout = "2006-01-02 15:04"
+
+// appointmentLength returns how long slots are.
+func appointmentLength() time.Duration {
+	minutes := CurrentConfig().AppointmentMinutes
+	if minutes == 0 {
+		minutes = DefaultConfig().AppointmentMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// PublishAvailability adds block, in which block.TA is available for
+// appointments. block must start after now, be long enough for at least
+// one slot, and not overlap the TA's other blocks. Returns the block with
+// its ID.
+func PublishAvailability(block AvailabilityBlock, now time.Time) (AvailabilityBlock, error) {
+	if !block.Start.After(now) {
+		return block, errors.New("appointments must start in the future")
+	}
+	if block.End.Sub(block.Start) < appointmentLength() {
+		return block, fmt.Errorf("the block must be at least %d minutes long", int(appointmentLength().Minutes()))
+	}
+	if block.Category != "" && !IsValidCategory(block.Category) {
+		return block, fmt.Errorf("unknown category %q", block.Category)
+	}
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	for _, other := range queue.Availability {
+		if other.TA == block.TA && other.Start.Before(block.End) && block.Start.Before(other.End) {
+			return block, errors.New("the block overlaps another one of yours")
+		}
+	}
+	queue.LastBlockID++
+	block.ID = queue.LastBlockID
+	queue.Availability = append(queue.Availability, block)
+	UpdateDiskCopy()
+	return block, nil
+}
+
+// RemoveAvailability removes TA's block with given ID, and cancels the
+// bookings in it that haven't entered the queue yet. Returns the block and
+// the cancelled bookings, whose students are told.
+func RemoveAvailability(TA string, ID uint) (AvailabilityBlock, []Booking, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	for i, block := range queue.Availability {
+		if block.ID != ID || block.TA != TA {
+			continue
+		}
+		queue.Availability = append(queue.Availability[:i:i], queue.Availability[i+1:]...)
+		var cancelled []Booking
+		for j, booking := range queue.Bookings {
+			if booking.BlockID == ID && !booking.Cancelled && booking.TicketID == 0 {
+				queue.Bookings[j].Cancelled = true
+				cancelled = append(cancelled, queue.Bookings[j])
+				publishBookingEvent(EventBookingCancelled, queue.Bookings[j])
+			}
+		}
+		UpdateDiskCopy()
+		return block, cancelled, true
+	}
+	return AvailabilityBlock{}, nil, false
+}
+
+// TAAvailability returns TA's blocks that haven't ended at now, by start.
+func TAAvailability(TA string, now time.Time) []AvailabilityBlock {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	acc := []AvailabilityBlock{}
+	for _, block := range queue.Availability {
+		if block.TA == TA && block.End.After(now) {
+			acc = append(acc, block)
+		}
+	}
+	sortBlocks(acc)
+	return acc
+}
+
+// TABookings returns the bookings in TA's blocks that haven't ended at now,
+// and weren't cancelled, by start.
+func TABookings(TA string, now time.Time) []Booking {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	acc := []Booking{}
+	for _, booking := range queue.Bookings {
+		if booking.TA == TA && !booking.Cancelled && booking.End.After(now) {
+			acc = append(acc, booking)
+		}
+	}
+	sortBookings(acc)
+	return acc
+}
+
+// FreeSlots returns the slots that start after now and nobody booked, by
+// start.
+func FreeSlots(now time.Time) []Slot {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	blocks := append([]AvailabilityBlock{}, queue.Availability...)
+	sortBlocks(blocks)
+	acc := []Slot{}
+	for _, block := range blocks {
+		for _, slot := range blockSlots(block) {
+			if slot.Start.After(now) && !isBookedLocked(slot) {
+				acc = append(acc, slot)
+			}
+		}
+	}
+	sortSlots(acc)
+	return acc
+}
+
+// BookSlot books the slot of the block with ID booking.BlockID that starts
+// at booking.Start for the student of booking, at now. Fails with
+// ErrSlotTaken, ErrBookingLimit or ErrDoubleBooked. Returns the booking with
+// its ID.
+func BookSlot(booking Booking, now time.Time) (Booking, error) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	var slot Slot
+	found := false
+	for _, block := range queue.Availability {
+		if block.ID != booking.BlockID {
+			continue
+		}
+		for _, s := range blockSlots(block) {
+			if s.Start.Equal(booking.Start) && s.Start.After(now) && !isBookedLocked(s) {
+				slot, found = s, true
+			}
+		}
+	}
+	if !found {
+		return booking, ErrSlotTaken
+	}
+	booked := uint(0)
+	for _, other := range queue.Bookings {
+		if other.CSid != booking.CSid || other.Cancelled {
+			continue
+		}
+		if other.Start.Before(slot.End) && slot.Start.Before(other.End) {
+			return booking, ErrDoubleBooked
+		}
+		if other.BookedAt.After(now.AddDate(0, 0, -7)) {
+			booked++
+		}
+	}
+	if booked >= CurrentConfig().MaxBookingsPerWeek {
+		return booking, ErrBookingLimit
+	}
+	queue.LastBookingID++
+	booking.ID = queue.LastBookingID
+	booking.TA = slot.TA
+	booking.Category = slot.Category
+	booking.End = slot.End
+	booking.BookedAt = now
+	queue.Bookings = append(queue.Bookings, booking)
+	publishBookingEvent(EventBooked, booking)
+	UpdateDiskCopy()
+	return booking, nil
+}
+
+// CancelBooking cancels the booking with given ID of the student with given
+// CSid, unless it already entered the queue.
+func CancelBooking(CSid string, ID uint) (Booking, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	for i, booking := range queue.Bookings {
+		if booking.ID == ID && booking.CSid == CSid && !booking.Cancelled && booking.TicketID == 0 {
+			queue.Bookings[i].Cancelled = true
+			UpdateDiskCopy()
+			return queue.Bookings[i], true
+		}
+	}
+	return Booking{}, false
+}
+
+// StudentBookings returns the bookings of the student with given CSid that
+// haven't ended at now, and weren't cancelled, by start.
+func StudentBookings(CSid string, now time.Time) []Booking {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	acc := []Booking{}
+	for _, booking := range queue.Bookings {
+		if booking.CSid == CSid && !booking.Cancelled && booking.End.After(now) {
+			acc = append(acc, booking)
+		}
+	}
+	sortBookings(acc)
+	return acc
+}
+
+// StudentBooking returns the booking with given ID of the student with
+// given CSid.
+func StudentBooking(CSid string, ID uint) (Booking, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	for _, booking := range queue.Bookings {
+		if booking.ID == ID && booking.CSid == CSid {
+			return booking, true
+		}
+	}
+	return Booking{}, false
+}
+
+// AdmitDueBookings puts the bookings whose slot has started at now at the
+// head of the queue, ahead of students who walked in. Students who were
+// already waiting keep their ticket, which moves to the head. Help limits
+// don't apply, as the student already booked. Returns the tickets of the
+// bookings.
+func AdmitDueBookings(now time.Time) []QueueEntry {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	admitted := []QueueEntry{}
+	for i, booking := range queue.Bookings {
+		if booking.Cancelled || booking.TicketID != 0 || booking.Start.After(now) || !booking.End.After(now) {
+			continue
+		}
+		var ticket QueueEntry
+		if j := waitingIndexForCSid(booking.CSid); j >= 0 {
+			queue.Entries[j].BookingID = booking.ID
+			queue.Entries[j].AppointmentWith = booking.TA
+			ticket = queue.Entries[j]
+			publishQueueEvent(EventMoved, ticket)
+		} else {
+			ticket = QueueEntry{
+				ID:              queue.NextID,
+				CSid:            booking.CSid,
+				Name:            booking.Name,
+				TaskInfo:        booking.TaskInfo,
+				Category:        booking.Category,
+				JoinedAt:        now,
+				ServedAt:        now,
+				Email:           booking.Email,
+				Locale:          booking.Locale,
+				BookingID:       booking.ID,
+				AppointmentWith: booking.TA,
+			}
+			queue.NextID++
+			queue.Entries = append(queue.Entries, ticket)
+			publishQueueEvent(EventJoined, ticket)
+		}
+		queue.Bookings[i].TicketID = ticket.ID
+		admitted = append(admitted, ticket)
+	}
+	if len(admitted) > 0 {
+		UpdateDiskCopy()
+	}
+	return admitted
+}
+
+// RunAppointments admits bookings as their slot starts, checking every
+// minute. Never returns.
+func RunAppointments() {
+	for {
+		for _, ticket := range AdmitDueBookings(time.Now()) {
+			slog.Info("An appointment entered the queue.", append(ticketAttrs(ticket), "booking", ticket.BookingID,
+				"ta", ticket.AppointmentWith)...)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// waitingIndexForCSid returns the index in queue.Entries of the ticket the
+// student with given CSid is waiting with, or -1.
+// The caller of this function should have locked the mutex before calling it.
+func waitingIndexForCSid(CSid string) int {
+	for i, entry := range queue.Entries {
+		if entry.CSid == CSid && entry.IsWaiting() {
+			return i
+		}
+	}
+	return -1
+}
+
+// blockSlots splits block into slots of Config.AppointmentMinutes. What is
+// left at the end is too short for a slot, and isn't bookable.
+func blockSlots(block AvailabilityBlock) []Slot {
+	length := appointmentLength()
+	var slots []Slot
+	for start := block.Start; !start.Add(length).After(block.End); start = start.Add(length) {
+		slots = append(slots, Slot{BlockID: block.ID, TA: block.TA, Category: block.Category,
+			Start: start, End: start.Add(length)})
+	}
+	return slots
+}
+
+// isBookedLocked returns whether somebody booked slot, and didn't cancel.
+// The caller of this function should have locked the mutex before calling it.
+func isBookedLocked(slot Slot) bool {
+	for _, booking := range queue.Bookings {
+		if booking.BlockID == slot.BlockID && booking.Start.Equal(slot.Start) && !booking.Cancelled {
+			return true
+		}
+	}
+	return false
+}
+
+func sortBlocks(blocks []AvailabilityBlock) {
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].Start.Before(blocks[j].Start) })
+}
+
+func sortSlots(slots []Slot) {
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+}
+
+func sortBookings(bookings []Booking) {
+	sort.SliceStable(bookings, func(i, j int) bool { return bookings[i].Start.Before(bookings[j].Start) })
+}
+
+// publishBookingEvent hands an event about booking to every registered
+// notifier.
+// The caller of this function should have locked the mutex before calling it.
+func publishBookingEvent(kind QueueEventKind, booking Booking) {
+	if len(notifierChannels) == 0 {
+		return
+	}
+	publishEvent(QueueEvent{Kind: kind, Booking: booking, Waiting: unservedEntriesLocked()})
+}
+
+// anonymiseBooking strips everything that identifies the student from the
+// booking, like anonymise does for tickets.
+func anonymiseBooking(booking Booking) Booking {
+	booking.CSid = Pseudonym(booking.CSid, CurrentConfig().PseudonymKey)
+	booking.Name = ""
+	booking.TaskInfo = ""
+	booking.Email = ""
+	booking.Anonymised = true
+	return booking
+}
+
+// BookingICS returns an iCalendar file with booking in it, for the
+// student's calendar.
+func BookingICS(booking Booking, courseName string) string {
+	const stamp = "20060102T150405Z"
+	summary := Translate(booking.Locale, "%s appointment", courseName)
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//210-queue-system//Appointments//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:booking-%d-%d@210-queue-system", booking.ID, booking.BookedAt.Unix()),
+		"DTSTAMP:" + booking.BookedAt.UTC().Format(stamp),
+		"DTSTART:" + booking.Start.UTC().Format(stamp),
+		"DTEND:" + booking.End.UTC().Format(stamp),
+		"SUMMARY:" + icsText(summary),
+		"DESCRIPTION:" + icsText(booking.TaskInfo),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(foldICSLine(line))
+	}
+	return ics.String()
+}
+
+// icsText escapes text for an iCalendar TEXT value.
+var icsText = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace
+
+// foldICSLine ends line with CRLF, folding it into lines of at most 75
+// bytes, as iCalendar requires, without splitting UTF-8 characters.
+func foldICSLine(line string) string {
+	var folded strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74 // The leading space counts.
+	}
+	folded.WriteString(line + "\r\n")
+	return folded.String()
+}
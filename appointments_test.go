@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppointments(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, blocks []AvailabilityBlock, bookings []Booking) {
+		queue.Entries, queue.NextID, queue.Availability, queue.Bookings = entries, nextID, blocks, bookings
+	}(queue.Entries, queue.NextID, queue.Availability, queue.Bookings)
+	defer SetConfig(*CurrentConfig())
+	SetConfig(DefaultConfig())
+	queue.Entries, queue.Availability, queue.Bookings = []QueueEntry{}, nil, nil
+
+	now := time.Now().Truncate(time.Minute)
+	start := now.Add(time.Hour)
+	_, err := PublishAvailability(AvailabilityBlock{TA: "ta1", Start: now.Add(-time.Hour), End: now}, now)
+	require.EqualError(t, err, "appointments must start in the future")
+	_, err = PublishAvailability(AvailabilityBlock{TA: "ta1", Start: start, End: start.Add(10 * time.Minute)}, now)
+	require.EqualError(t, err, "the block must be at least 15 minutes long")
+	block, err := PublishAvailability(AvailabilityBlock{TA: "ta1", Start: start, End: start.Add(40 * time.Minute)}, now)
+	require.NoError(t, err)
+	_, err = PublishAvailability(AvailabilityBlock{TA: "ta1", Start: start.Add(30 * time.Minute), End: start.Add(time.Hour)}, now)
+	require.EqualError(t, err, "the block overlaps another one of yours")
+	_, err = PublishAvailability(AvailabilityBlock{TA: "ta2", Start: start, End: start.Add(15 * time.Minute)}, now)
+	require.NoError(t, err)
+
+	// The last 10 minutes of the first block are too short for a slot.
+	slots := FreeSlots(now)
+	require.Len(t, slots, 3)
+	require.Equal(t, "ta1", slots[0].TA)
+	require.Equal(t, start.Add(15*time.Minute), slots[2].Start)
+
+	booking, err := BookSlot(Booking{BlockID: block.ID, Start: start, CSid: "r3a1b", Name: "Joe Student", TaskInfo: "Demo"}, now)
+	require.NoError(t, err)
+	require.Equal(t, "ta1", booking.TA)
+	require.Equal(t, start.Add(15*time.Minute), booking.End)
+	require.Len(t, FreeSlots(now), 2)
+	_, err = BookSlot(Booking{BlockID: block.ID, Start: start, CSid: "r3a2b"}, now)
+	require.Equal(t, ErrSlotTaken, err)
+	_, err = BookSlot(Booking{BlockID: block.ID, Start: start.Add(time.Minute), CSid: "r3a2b"}, now)
+	require.Equal(t, ErrSlotTaken, err)
+	_, err = BookSlot(Booking{BlockID: block.ID + 1, Start: start, CSid: "r3a1b"}, now)
+	require.Equal(t, ErrDoubleBooked, err)
+	_, err = BookSlot(Booking{BlockID: block.ID, Start: start.Add(15 * time.Minute), CSid: "r3a1b"}, now)
+	require.Equal(t, ErrBookingLimit, err)
+
+	// Cancelling frees the slot, and the student's quota.
+	_, found := CancelBooking("r3a2b", booking.ID)
+	require.False(t, found)
+	_, found = CancelBooking("r3a1b", booking.ID)
+	require.True(t, found)
+	require.Empty(t, StudentBookings("r3a1b", now))
+	booking, err = BookSlot(Booking{BlockID: block.ID, Start: start.Add(15 * time.Minute), CSid: "r3a1b", Name: "Joe Student"}, now)
+	require.NoError(t, err)
+	other, err := BookSlot(Booking{BlockID: block.ID + 1, Start: start, CSid: "r3a2b", Name: "Diligent Student"}, now)
+	require.NoError(t, err)
+	require.Len(t, StudentBookings("r3a1b", now), 1)
+	require.Len(t, TABookings("ta1", now), 1)
+
+	// Bookings go ahead of everybody who walked in when their slot starts,
+	// in the order they start.
+	JoinQueue(QueueEntry{Name: "Walk-in", CSid: "r3a3b", TaskInfo: "Lost.", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Diligent Student", CSid: "r3a2b", TaskInfo: "Lost.", Locale: DefaultLocale})
+	require.Empty(t, AdmitDueBookings(now))
+	admitted := AdmitDueBookings(start)
+	require.Len(t, admitted, 1)
+	require.Equal(t, "r3a2b", admitted[0].CSid) // Kept their ticket.
+	require.Equal(t, other.ID, admitted[0].BookingID)
+	admitted = AdmitDueBookings(start.Add(15 * time.Minute))
+	require.Len(t, admitted, 1)
+	require.Equal(t, "Joe Student", admitted[0].Name)
+	require.Empty(t, AdmitDueBookings(start.Add(20*time.Minute)))
+	require.Equal(t, []string{"r3a2b", "r3a1b", "r3a3b"}, csids(UnservedEntries()))
+	_, position := QueuePositionForCSID("r3a3b")
+	require.Equal(t, uint(2), position)
+	_, found = CancelBooking("r3a1b", booking.ID)
+	require.False(t, found) // Too late.
+
+	// Appointments are only taken by the TA who was booked.
+	entry, found := TakeNext("ta3")
+	require.True(t, found)
+	require.Equal(t, "r3a3b", entry.CSid)
+	entry, found = TakeNext("ta1")
+	require.True(t, found)
+	require.Equal(t, "r3a1b", entry.CSid)
+
+	// Removing a block cancels what wasn't admitted yet.
+	later, err := PublishAvailability(AvailabilityBlock{TA: "ta1", Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)}, now)
+	require.NoError(t, err)
+	_, err = BookSlot(Booking{BlockID: later.ID, Start: later.Start, CSid: "r3a4b"}, now)
+	require.NoError(t, err)
+	_, cancelled, found := RemoveAvailability("ta2", later.ID)
+	require.False(t, found)
+	_, cancelled, found = RemoveAvailability("ta1", later.ID)
+	require.True(t, found)
+	require.Len(t, cancelled, 1)
+	require.Empty(t, StudentBookings("r3a4b", now))
+}
+
+func TestBookingICS(t *testing.T) {
+	start := time.Date(2019, time.March, 4, 10, 0, 0, 0, time.UTC)
+	booking := Booking{ID: 7, Start: start, End: start.Add(15 * time.Minute), BookedAt: start.AddDate(0, 0, -1),
+		TaskInfo: "Phase 2 demo; bring laptop, " + strings.Repeat("é", 40), Locale: DefaultLocale}
+	ics := BookingICS(booking, "CPSC 210")
+	require.Contains(t, ics, "BEGIN:VEVENT\r\n")
+	require.Contains(t, ics, "UID:booking-7-1551607200@210-queue-system\r\n")
+	require.Contains(t, ics, "DTSTART:20190304T100000Z\r\n")
+	require.Contains(t, ics, "DTEND:20190304T101500Z\r\n")
+	require.Contains(t, ics, "SUMMARY:CPSC 210 appointment\r\n")
+	require.Contains(t, ics, `DESCRIPTION:Phase 2 demo\; bring laptop\, `)
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		require.LessOrEqual(t, len(line), 75)
+	}
+	require.Contains(t, strings.ReplaceAll(ics, "\r\n ", ""), strings.Repeat("é", 40))
+}
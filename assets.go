@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+)
+
+// This file serves the templates, static files and translations, which are
+// embedded in the binary. Files in Config.TemplatesDir, Config.StaticDir and
+// Config.LocalesDir, if set, take precedence over the embedded ones, so that
+// a course can customise some of them without rebuilding.
+
+//go:embed templates static locales
+var embeddedAssets embed.FS
+
+// How long browsers can cache static files requested with their hash.
+const staticMaxAge = 365 * 24 * 60 * 60
+
+// overlayFS serves files from dir if they exist there, and from base
+// otherwise.
+type overlayFS struct {
+	dir  fs.FS
+	base fs.FS
+}
+
+// Open implements fs.FS.
+func (o overlayFS) Open(name string) (fs.File, error) {
+	file, err := o.dir.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	return o.base.Open(name)
+}
+
+// ReadDir implements fs.ReadDirFS, listing the files in both.
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(o.dir, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		seen[entry.Name()] = true
+	}
+	baseEntries, baseErr := fs.ReadDir(o.base, name)
+	if baseErr != nil && err != nil {
+		return nil, baseErr
+	}
+	for _, entry := range baseEntries {
+		if !seen[entry.Name()] {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// AssetFS returns the embedded directory with the given name (templates,
+// static or locales), with the files in overrideDir on top if it is set.
+func AssetFS(name string, overrideDir string) fs.FS {
+	base, err := fs.Sub(embeddedAssets, name)
+	if err != nil {
+		panic(err) // The directory is embedded, so this can't happen.
+	}
+	if overrideDir == "" {
+		return base
+	}
+	return overlayFS{dir: os.DirFS(overrideDir), base: base}
+}
+
+// LoadTemplates parses every template in fsys.
+func LoadTemplates(fsys fs.FS, funcs template.FuncMap) (*template.Template, error) {
+	return template.New("").Delims("{{", "}}").Funcs(funcs).ParseFS(fsys, "*.tmpl.html")
+}
+
+// StaticHashes returns a short hash of the contents of every file in fsys,
+// by path.
+func StaticHashes(fsys fs.FS) (map[string]string, error) {
+	hashes := map[string]string{}
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(contents)
+		hashes[name] = hex.EncodeToString(sum[:])[:12]
+		return nil
+	})
+	return hashes, err
+}
+
+// AssetURL returns a function giving the URL of a static file, with its
+// hash in the query string so that browsers fetch it again when it changes.
+// For use in templates, as {{Asset "css/main.css"}}.
+func AssetURL(hashes map[string]string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		hash, ok := hashes[name]
+		if !ok {
+			return "", fmt.Errorf("no static file named %q", name)
+		}
+		return "/static/" + name + "?v=" + hash, nil
+	}
+}
+
+// StaticCacheHeaders lets browsers cache static files for a year when they
+// are requested with their current hash, see AssetURL. Other requests, such
+// as those for the service worker, are revalidated every time.
+func StaticCacheHeaders(hashes map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := path.Clean(c.Param("filepath"))[1:]
+		if hash, ok := hashes[name]; ok && c.Query("v") == hash {
+			c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", staticMaxAge))
+		} else {
+			c.Header("Cache-Control", "no-cache")
+		}
+	}
+}
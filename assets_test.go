@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssetOverrides(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "css"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "css", "main.css"), []byte("body{}"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "css", "extra.css"), []byte("p{}"), 0600))
+
+	static := AssetFS("static", dir)
+	contents, err := fs.ReadFile(static, "css/main.css")
+	require.NoError(t, err)
+	require.Equal(t, "body{}", string(contents))
+	_, err = fs.ReadFile(static, "js/push-sw.js") // Not overridden.
+	require.NoError(t, err)
+	entries, err := fs.ReadDir(static, "css")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Contains(t, names, "extra.css")
+	require.Contains(t, names, "bootstrap.min.css")
+
+	hashes, err := StaticHashes(static)
+	require.NoError(t, err)
+	embedded, err := StaticHashes(AssetFS("static", ""))
+	require.NoError(t, err)
+	require.NotEqual(t, embedded["css/main.css"], hashes["css/main.css"])
+	url, err := AssetURL(hashes)("css/main.css")
+	require.NoError(t, err)
+	require.Equal(t, "/static/css/main.css?v="+hashes["css/main.css"], url)
+	_, err = AssetURL(hashes)("css/missing.css")
+	require.Error(t, err)
+}
+
+func TestEmbeddedTemplates(t *testing.T) {
+	templates, err := LoadTemplates(AssetFS("templates", ""), templateFuncs(map[string]string{}))
+	require.NoError(t, err)
+	require.NotNil(t, templates.Lookup("index.tmpl.html"))
+	require.NotNil(t, templates.Lookup("tastatus.tmpl.html"))
+}
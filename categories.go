@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file contains the categories students pick from when joining the
+// queue, for instance "Lab 5" or "Exam review". Instructors manage the list,
+// and TAs can subscribe to the categories they are comfortable with.
+
+// How long a category name can be, so that it fits on the TA panel.
+const maxCategoryLength = 40
+
+// Categories returns the categories students can pick from.
+func Categories() []string {
+	queue.Mutex.Lock()
+	categories := append([]string{}, queue.Categories...)
+	queue.Mutex.Unlock()
+	return categories
+}
+
+// SetCategories replaces the categories students can pick from. Tickets keep
+// the category they were created with, but TAs are unsubscribed from the
+// categories that are gone.
+func SetCategories(categories []string) error {
+	seen := map[string]bool{}
+	for _, category := range categories {
+		if category == "" || utf8.RuneCountInString(category) > maxCategoryLength {
+			return fmt.Errorf("categories must be between 1 and %d characters long, got %q", maxCategoryLength, category)
+		}
+		if seen[category] {
+			return fmt.Errorf("category %q is listed twice", category)
+		}
+		seen[category] = true
+	}
+	queue.Mutex.Lock()
+	queue.Categories = categories
+	for TA, subscribed := range queue.TACategories {
+		kept := []string{}
+		for _, category := range subscribed {
+			if seen[category] {
+				kept = append(kept, category)
+			}
+		}
+		queue.TACategories[TA] = kept
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return nil
+}
+
+// ParseCategories splits text into categories, one per line.
+func ParseCategories(text string) []string {
+	categories := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			categories = append(categories, line)
+		}
+	}
+	return categories
+}
+
+// IsValidCategory returns whether students can pick category.
+func IsValidCategory(category string) bool {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	for _, c := range queue.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTACategories subscribes TA to categories, and unsubscribes them from
+// the others. Unknown categories are ignored.
+func SetTACategories(TA string, categories []string) {
+	queue.Mutex.Lock()
+	subscribed := []string{}
+	for _, category := range queue.Categories {
+		for _, c := range categories {
+			if c == category {
+				subscribed = append(subscribed, category)
+				break
+			}
+		}
+	}
+	if queue.TACategories == nil {
+		queue.TACategories = map[string][]string{}
+	}
+	queue.TACategories[TA] = subscribed
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+}
+
+// TACategories returns the categories TA subscribed to.
+func TACategories(TA string) []string {
+	queue.Mutex.Lock()
+	categories := append([]string{}, queue.TACategories[TA]...)
+	queue.Mutex.Unlock()
+	return categories
+}
+
+// InCategories returns whether entry is in one of categories. Every ticket
+// is in an empty list of categories.
+func InCategories(entry QueueEntry, categories []string) bool {
+	if len(categories) == 0 {
+		return true
+	}
+	for _, category := range categories {
+		if entry.Category == category {
+			return true
+		}
+	}
+	return false
+}
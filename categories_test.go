@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestCategories(t *testing.T) {
+	defer func(categories []string, subscriptions map[string][]string) {
+		queue.Categories, queue.TACategories = categories, subscriptions
+	}(queue.Categories, queue.TACategories)
+	queue.Categories, queue.TACategories = nil, nil
+
+	require.Equal(t, []string{"Lab 5", "Project phase 2"}, ParseCategories(" Lab 5\r\n\nProject phase 2\n"))
+	require.EqualError(t, SetCategories([]string{"Lab 5", "Lab 5"}), `category "Lab 5" is listed twice`)
+	require.Error(t, SetCategories([]string{strings.Repeat("x", maxCategoryLength+1)}))
+	require.NoError(t, SetCategories([]string{"Lab 5", "Project phase 2", "Exam review"}))
+	require.True(t, IsValidCategory("Exam review"))
+	require.False(t, IsValidCategory("Lab 6"))
+
+	SetTACategories("ta1", []string{"Exam review", "Lab 6", "Lab 5"})
+	require.Equal(t, []string{"Lab 5", "Exam review"}, TACategories("ta1"))
+	require.Empty(t, TACategories("ta2"))
+	require.True(t, InCategories(QueueEntry{Category: "Lab 5"}, TACategories("ta1")))
+	require.False(t, InCategories(QueueEntry{Category: "Project phase 2"}, TACategories("ta1")))
+	require.True(t, InCategories(QueueEntry{}, nil))
+
+	// TAs are unsubscribed from categories that are gone.
+	require.NoError(t, SetCategories([]string{"Lab 5", "Lab 6"}))
+	require.Equal(t, []string{"Lab 5"}, TACategories("ta1"))
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"time"
 )
 
 // This file contains functions used by the application to integrate with
@@ -16,6 +17,9 @@ import (
 
 var students map[string]string // CSid -> LabSection
 
+// When LoadClassyData last succeeded. Zero if the roster was never loaded.
+var rosterLoadedAt time.Time
+
 const CLASSY_ENDPOINT = "https://cs210.ugrad.cs.ubc.ca/portal/admin/students"
 const CLASSY_USER = "queueapp"
 const CLASSY_TOKEN = "surely-not-posting-this-on-github-dude"
@@ -34,18 +38,22 @@ func LoadClassyData() bool {
 	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
-		log.Println("Failed to connect to Classy to retrieve registration info:", err)
+		slog.Error("Failed to connect to Classy to retrieve registration info.", "error", err)
 		return false
 	}
 	if response.StatusCode != http.StatusOK {
-		log.Println("Classy returned a non-200 status code while fetching registration info:", err)
+		slog.Error("Classy returned a non-200 status code while fetching registration info.", "status", response.StatusCode)
 		return false
 	}
 
 	// TODO: fill the `students` map here by parsing the json response
 	_, _ = io.Copy(os.Stdout, response.Body)
 	_ = response.Body.Close()
-	return len(students) > 0
+	if len(students) == 0 {
+		return false
+	}
+	rosterLoadedAt = time.Now()
+	return true
 }
 
 // LabSectionForStudent returns true if the given string contains
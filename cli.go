@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// This file contains the command-line subcommands, for maintenance tasks
+// that are run from a shell rather than from the web interface.
+// Running the binary without a subcommand starts the web server.
+
+// The version of the application, set when building releases with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// RunCommand runs the subcommand named in args[0], if there is one, and
+// returns its exit status. Returns false if args don't name a subcommand.
+func RunCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "export":
+		return runExportCommand(args[1:]), true
+	case "genkey":
+		fmt.Println(GenerateDataKey())
+		return 0, true
+	case "reencrypt":
+		return runReencryptCommand(), true
+	}
+	return 0, false
+}
+
+// runExportCommand writes an export of the ticket history to stdout.
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "csv or ndjson")
+	columns := flags.String("columns", "", "comma-separated list of columns (default: all of them)")
+	from := flags.String("from", "", "only export tickets created on or after this day (YYYY-MM-DD)")
+	to := flags.String("to", "", "only export tickets created on or before this day (YYYY-MM-DD)")
+	pseudonymise := flags.Bool("pseudonymise", false, "replace CSids with pseudonyms")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	opts, err := exportOptions(*format, *columns, *from, *to, *pseudonymise)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	LoadDataFromDisk()
+	if storeStatus != StoreLoaded {
+		fmt.Fprintf(os.Stderr, "Couldn't load persistence.json (%s), nothing was exported.\n", storeStatus)
+		return 1
+	}
+	if err := WriteExport(os.Stdout, AllEntries(), opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// exportOptions validates the export settings chosen by the user. Unless a
+// range is given, every ticket is exported.
+func exportOptions(format string, columns string, from string, to string, pseudonymise bool) (ExportOptions, error) {
+	opts := ExportOptions{
+		Format:       format,
+		Pseudonymise: pseudonymise,
+		PseudonymKey: CurrentConfig().PseudonymKey,
+	}
+	if format != "csv" && format != "ndjson" {
+		return opts, fmt.Errorf("unknown format %q, expected csv or ndjson", format)
+	}
+	var err error
+	if opts.Columns, err = ParseExportColumns(columns); err != nil {
+		return opts, err
+	}
+	if pseudonymise && columns == "" {
+		opts.Columns = nil
+		for _, column := range DefaultExportColumns {
+			if !identifyingExportColumns[column] {
+				opts.Columns = append(opts.Columns, column)
+			}
+		}
+	}
+	opts.From, opts.To, err = ParseDateRange(from, to, time.Time{}, Today())
+	return opts, err
+}
+
+// BuildInfo describes the binary: its version, the Go version it was built
+// with, and the commit it was built from if it was built in a checkout.
+func BuildInfo() string {
+	info := fmt.Sprintf("210-queue-system %s\n", version)
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info += fmt.Sprintf("go: %s\n", build.GoVersion)
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH":
+			info += fmt.Sprintf("%s: %s\n", setting.Key, setting.Value)
+		}
+	}
+	return info
+}
+
+// runReencryptCommand rewrites persistence.json with the current encryption
+// key, after rotating keys or turning encryption on or off. The server must
+// not be running, or it will overwrite the file with its own copy later on.
+// Nothing is written unless the existing file was loaded.
+func runReencryptCommand() int {
+	LoadDataFromDisk()
+	if storeStatus != StoreLoaded {
+		fmt.Fprintf(os.Stderr, "Couldn't load persistence.json (%s), it was left as it is.\n", storeStatus)
+		return 1
+	}
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	if err := UpdateDiskCopy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// This file contains the application configuration. Settings are read from
+// a JSON file (config.json by default), then from QUEUE_* environment
+// variables, then from command-line flags, each overriding the previous one.
+
+// A type that stores the application configuration. Every setting can be
+// given on the command line with the flag in its tag, or in the environment
+// variable named after the flag: -listen-at becomes QUEUE_LISTEN_AT. Lists
+// are comma-separated. Webhooks, RateLimits, CategoryLimits and Theme can
+// only be set in the file.
+type Config struct {
+	// ListenAt is the HTTP port the web-server should listen at for incoming
+	// connections.
+	ListenAt string `flag:"listen-at" usage:"HTTP port to listen at"`
+
+	// AuthSecret is a random string that is used when hashing CSids and
+	// storing them in a cookie.
+	// This kind of crypto is used to ensure that only whoever joined
+	// the queue can actually leave it manually (/leaveearly).
+	AuthSecret string `flag:"auth-secret" usage:"random string used to sign student cookies"`
+
+	// MaxNumTimesHelped is the maximum number of times a student can seek
+	// help within a 24 hour timeframe.
+	MaxNumTimesHelped uint `flag:"max-num-times-helped" usage:"how many times a student can be helped in 24 hours"`
+
+	// The other help limits are turned off when they are 0 or empty, see
+	// limits.go. CategoryLimits is how many times a student can be helped
+	// in 24 hours with questions in each category. Students in
+	// LimitExemptCSids, for instance those with accommodations, are never
+	// turned away, and nobody is if AllowOverLimitWhenEmpty is set and
+	// nobody is waiting.
+	MaxTimesHelpedPerWeek   uint `flag:"max-times-helped-per-week" usage:"how many times a student can be helped in 7 days, 0 for no limit"`
+	HelpCooldownMinutes     uint `flag:"help-cooldown-minutes" usage:"how many minutes after being helped students can join again"`
+	CategoryLimits          map[string]uint
+	LimitExemptCSids        []string `flag:"limit-exempt-csids" usage:"CS IDs of students who are never turned away"`
+	AllowOverLimitWhenEmpty bool     `flag:"allow-over-limit-when-empty" usage:"let students over a limit join when nobody is waiting"`
+
+	// TAs publish blocks of time students can book appointments in, split
+	// into slots of AppointmentMinutes. A student can book
+	// MaxBookingsPerWeek appointments in 7 days, see appointments.go.
+	AppointmentMinutes uint `flag:"appointment-minutes" usage:"length of appointment slots in minutes"`
+	MaxBookingsPerWeek uint `flag:"max-bookings-per-week" usage:"how many appointments a student can book in 7 days"`
+
+	// When a TA can't find a student, or a student lets others go ahead of
+	// them, their ticket is deferred: DeferPositions students go ahead of
+	// them, or, if DeferMinutes is set, everybody goes ahead of them for
+	// that long. Tickets are dropped after MaxNoShows no-shows, or never if
+	// it is 0.
+	DeferPositions uint `flag:"defer-positions" usage:"how many students go ahead of a deferred ticket"`
+	DeferMinutes   uint `flag:"defer-minutes" usage:"how many minutes tickets are deferred for, instead of by position"`
+	MaxNoShows     uint `flag:"max-no-shows" usage:"how many no-shows a ticket is dropped after, 0 for never"`
+
+	// Students pick their lab section from LabSections when joining, if it
+	// isn't empty, so that instructors can have some sections helped first,
+	// see ordering.go.
+	LabSections []string `flag:"lab-sections" usage:"lab sections students pick from when joining"`
+
+	// Students in the lab pick where they are from Locations, for instance
+	// "Table 3", and remote students can share a link to a video meeting on
+	// one of MeetingDomains, or their subdomains. Either is turned off if
+	// the list is empty.
+	Locations      []string `flag:"locations" usage:"rooms and tables students in the lab can pick"`
+	MeetingDomains []string `flag:"meeting-domains" usage:"domains of the meeting links remote students can share"`
+
+	// Where we keep persistence.json, vapid.json and
+	// webhook_deadletters.json, and where we find the TA database.
+	// Templates, static files and translations are embedded in the binary,
+	// but files in TemplatesDir, StaticDir and LocalesDir take precedence,
+	// see assets.go.
+	DataDir      string `flag:"data-dir" usage:"directory for persistence.json and other data files"`
+	AuthDBFile   string `flag:"authdb" usage:"path to the TA database"`
+	TemplatesDir string `flag:"templates-dir" usage:"directory of templates overriding the built-in ones"`
+	StaticDir    string `flag:"static-dir" usage:"directory of static files overriding the built-in ones"`
+	LocalesDir   string `flag:"locales-dir" usage:"directory of translations overriding the built-in ones"`
+
+	// The SMTP settings are optional: email notifications are turned off
+	// unless SMTPHost is set. EmailAtPosition is how many students can be
+	// ahead of a student when we email them to come back to the lab.
+	SMTPHost        string `flag:"smtp-host" usage:"SMTP server for email notifications"`
+	SMTPPort        string `flag:"smtp-port" usage:"SMTP server port"`
+	SMTPUsername    string `flag:"smtp-username" usage:"SMTP username"`
+	SMTPPassword    string `flag:"smtp-password" usage:"SMTP password"`
+	SMTPFrom        string `flag:"smtp-from" usage:"From address of email notifications"`
+	EmailAtPosition uint   `flag:"email-at-position" usage:"queue position at which students are emailed"`
+
+	// See webhooks.go for the fields available in Webhooks.
+	// WebhookQueueLength is how many students need to be waiting before we
+	// tell the webhooks that the queue is getting long, and
+	// WebhookLongWaitMinutes how long a student can wait before we tell
+	// them about it.
+	Webhooks               []WebhookConfig
+	WebhookQueueLength     uint `flag:"webhook-queue-length" usage:"queue length that triggers long_queue webhooks"`
+	WebhookLongWaitMinutes uint `flag:"webhook-long-wait-minutes" usage:"wait in minutes that triggers long_wait webhooks"`
+
+	// VAPIDSubject is the contact URL (mailto: or https:) we give to the
+	// browser vendors' push services. Web Push is turned off unless it is set.
+	// PushThresholds are the positions in the queue at which we send a push
+	// notification to students who asked for one.
+	VAPIDSubject   string `flag:"vapid-subject" usage:"contact URL for Web Push services"`
+	PushThresholds []uint `flag:"push-thresholds" usage:"queue positions at which push notifications are sent"`
+
+	// PseudonymKey is used to replace CSids with pseudonyms in exports.
+	// Falls back to AuthSecret, but a separate key lets you rotate
+	// AuthSecret without changing every student's pseudonym.
+	PseudonymKey string `flag:"pseudonym-key" usage:"key used to pseudonymise CSids (default: AuthSecret)"`
+
+	// Instructors are the users in authdb.json who can erase data and change
+	// settings. If the list is empty, no TA can.
+	// After RetentionDays days, tickets are anonymised or deleted, depending
+	// on RetentionAction. Tickets are kept forever if RetentionDays is 0.
+	Instructors     []string `flag:"instructors" usage:"TAs who are instructors (default: none of them)"`
+	RetentionDays   uint     `flag:"retention-days" usage:"days after which tickets are anonymised or deleted"`
+	RetentionAction string   `flag:"retention-action" usage:"anonymise or delete"`
+
+	// EncryptionKeyFile contains the key persistence.json is encrypted with,
+	// unless the QUEUE_ENCRYPTION_KEY environment variable is set. Data is
+	// stored in plaintext if neither is. OldEncryptionKeyFiles are only used
+	// to read data written before the key was rotated.
+	EncryptionKeyFile     string   `flag:"encryption-key-file" usage:"file containing the key persistence.json is encrypted with"`
+	OldEncryptionKeyFiles []string `flag:"old-encryption-key-files" usage:"files containing previous encryption keys"`
+
+	// /metrics is only served to clients presenting MetricsToken as a bearer
+	// token, or connecting from one of the MetricsAllowedIPs (in CIDR
+	// notation). It is turned off if neither is set.
+	MetricsToken      string   `flag:"metrics-token" usage:"bearer token for /metrics"`
+	MetricsAllowedIPs []string `flag:"metrics-allowed-ips" usage:"networks allowed to read /metrics, in CIDR notation"`
+
+	// RateLimits limit how often each client IP and each CSid can call the
+	// public endpoints, by route, see ratelimit.go. Client IPs are taken
+	// from X-Forwarded-For only if the request comes from one of the
+	// TrustedProxies (in CIDR notation).
+	RateLimits     map[string]RouteLimits
+	TrustedProxies []string `flag:"trusted-proxies" usage:"networks of proxies whose X-Forwarded-For header is trusted"`
+
+	// Logs are written as JSON (or logfmt) lines to stderr. Student names,
+	// task descriptions and email addresses are redacted from them, unless
+	// LogStudentDetails is set.
+	LogFormat         string `flag:"log-format" usage:"json or logfmt"`
+	LogLevel          string `flag:"log-level" usage:"debug, info, warn or error"`
+	LogStudentDetails bool   `flag:"log-student-details" usage:"include student names and tasks in logs"`
+
+	// Theme is the branding of the web interface, see theme.go. Instructors
+	// can override it for each queue from /admin/theme.
+	Theme Theme
+}
+
+// The configuration in use. It is replaced as a whole when it is reloaded,
+// so that readers never see a mix of old and new settings.
+var currentConfig atomic.Pointer[Config]
+
+// CurrentConfig returns the configuration in use, which must not be modified.
+func CurrentConfig() *Config {
+	if cfg := currentConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &Config{}
+}
+
+// SetConfig replaces the configuration in use.
+func SetConfig(cfg Config) {
+	currentConfig.Store(&cfg)
+}
+
+// DefaultConfig returns the settings used for anything that isn't configured.
+func DefaultConfig() Config {
+	return Config{
+		ListenAt:               "8080",
+		MaxNumTimesHelped:      5,
+		DeferPositions:         3,
+		MaxNoShows:             3,
+		AppointmentMinutes:     15,
+		MaxBookingsPerWeek:     1,
+		DataDir:                ".",
+		AuthDBFile:             "authdb.json",
+		SMTPPort:               "25",
+		EmailAtPosition:        3,
+		WebhookQueueLength:     15,
+		WebhookLongWaitMinutes: 30,
+		PushThresholds:         []uint{5, 1, 0},
+		RetentionAction:        RetentionAnonymise,
+		LogFormat:              "json",
+		LogLevel:               "info",
+		Theme:                  DefaultTheme(),
+		RateLimits:             DefaultRateLimits(),
+	}
+}
+
+// DataPath returns the path of the data file with the given name.
+func (cfg Config) DataPath(name string) string {
+	return filepath.Join(cfg.DataDir, name)
+}
+
+// A ConfigError is a setting that is missing or has a bad value. Key is the
+// name of the setting where it was found: a config.json key, an environment
+// variable or a flag.
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+// A configField is a setting that can be given as an environment variable
+// and a flag.
+type configField struct {
+	Name  string // As in config.json.
+	Flag  string
+	Env   string
+	Usage string
+	Value reflect.Value
+}
+
+// configFields returns the settings of cfg that can be set from strings.
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	value := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		fields = append(fields, configField{
+			Name:  field.Name,
+			Flag:  name,
+			Env:   "QUEUE_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)),
+			Usage: field.Tag.Get("usage"),
+			Value: value.Field(i),
+		})
+	}
+	return fields
+}
+
+// set parses s into the field.
+func (f configField) set(s string) error {
+	switch f.Value.Interface().(type) {
+	case string:
+		f.Value.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", s)
+		}
+		f.Value.SetBool(b)
+	case uint:
+		n, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return fmt.Errorf("expected a positive whole number, got %q", s)
+		}
+		f.Value.SetUint(n)
+	case []string:
+		f.Value.Set(reflect.ValueOf(splitList(s)))
+	case []uint:
+		list := []uint{}
+		for _, item := range splitList(s) {
+			n, err := strconv.ParseUint(item, 10, 0)
+			if err != nil {
+				return fmt.Errorf("expected a list of positive whole numbers, got %q", item)
+			}
+			list = append(list, uint(n))
+		}
+		f.Value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("can't be set from a string")
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// LoadConfig reads the configuration, with args being the command-line
+// arguments and getenv looking up environment variables. The arguments left
+// after the flags (such as a subcommand) are returned.
+func LoadConfig(args []string, getenv func(string) string) (Config, []string, error) {
+	cfg := DefaultConfig()
+	fields := configFields(&cfg)
+
+	// Flags name the config file, so they are parsed first and applied last.
+	flags := flag.NewFlagSet("210-queue-system", flag.ContinueOnError)
+	path := getenv("QUEUE_CONFIG")
+	explicitPath := path != ""
+	if path == "" {
+		path = "config.json"
+	}
+	flags.Func("config", "path to the configuration file (env QUEUE_CONFIG, default config.json)", func(s string) error {
+		path, explicitPath = s, true
+		return nil
+	})
+	flagValues := map[string]string{}
+	for _, field := range fields {
+		field := field
+		usage := field.Usage + " (env " + field.Env + ")"
+		store := func(s string) error {
+			flagValues[field.Flag] = s
+			return nil
+		}
+		if field.Value.Kind() == reflect.Bool {
+			flags.BoolFunc(field.Flag, usage, store)
+		} else {
+			flags.Func(field.Flag, usage, store)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if err := readConfigFile(path, &cfg); err != nil {
+		if !os.IsNotExist(err) || explicitPath {
+			return cfg, nil, err
+		}
+		slog.Info("Couldn't find the configuration file, using defaults and environment variables.", "path", path)
+	}
+	for _, field := range fields {
+		if value := getenv(field.Env); value != "" {
+			if err := field.set(value); err != nil {
+				return cfg, nil, &ConfigError{field.Env, err}
+			}
+		}
+	}
+	for _, field := range fields {
+		if value, ok := flagValues[field.Flag]; ok {
+			if err := field.set(value); err != nil {
+				return cfg, nil, &ConfigError{"-" + field.Flag, err}
+			}
+		}
+	}
+
+	if cfg.PseudonymKey == "" {
+		cfg.PseudonymKey = cfg.AuthSecret
+	}
+	return cfg, flags.Args(), cfg.Validate()
+}
+
+// checkNames checks that names are distinct, and not empty.
+func checkNames(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" || seen[name] {
+			return fmt.Errorf("expected distinct, non-empty names, got %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// readConfigFile fills cfg with the settings in the JSON file at path.
+// Unknown keys are rejected, as they are most likely typos.
+func readConfigFile(path string, cfg *Config) error {
+	store, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(store))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ConfigError{typeErr.Field, fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that every setting has a usable value.
+func (cfg Config) Validate() error {
+	if port, err := strconv.ParseUint(cfg.ListenAt, 10, 16); err != nil || port == 0 {
+		return &ConfigError{"ListenAt", fmt.Errorf("expected a port number, got %q", cfg.ListenAt)}
+	}
+	if cfg.AuthSecret == "" {
+		return &ConfigError{"AuthSecret", errors.New("must be set to a random string")}
+	}
+	if cfg.MaxNumTimesHelped == 0 {
+		return &ConfigError{"MaxNumTimesHelped", errors.New("must be at least 1, or every student is turned away")}
+	}
+	for category, limit := range cfg.CategoryLimits {
+		if category == "" || limit == 0 {
+			return &ConfigError{"CategoryLimits", fmt.Errorf("expected a category and a limit of at least 1, got %q: %d", category, limit)}
+		}
+	}
+	if err := checkNames(cfg.LimitExemptCSids); err != nil {
+		return &ConfigError{"LimitExemptCSids", err}
+	}
+	if cfg.AppointmentMinutes == 0 {
+		return &ConfigError{"AppointmentMinutes", errors.New("must be at least 1")}
+	}
+	if cfg.MaxBookingsPerWeek == 0 {
+		return &ConfigError{"MaxBookingsPerWeek", errors.New("must be at least 1, or no student can book an appointment")}
+	}
+	if cfg.DeferPositions == 0 && cfg.DeferMinutes == 0 {
+		return &ConfigError{"DeferPositions", errors.New("must be at least 1, unless DeferMinutes is set")}
+	}
+	if err := checkNames(cfg.LabSections); err != nil {
+		return &ConfigError{"LabSections", err}
+	}
+	if err := checkNames(cfg.Locations); err != nil {
+		return &ConfigError{"Locations", err}
+	}
+	for _, domain := range cfg.MeetingDomains {
+		if domain == "" || strings.ContainsAny(domain, ":/@ ") {
+			return &ConfigError{"MeetingDomains", fmt.Errorf("expected a domain name such as zoom.us, got %q", domain)}
+		}
+	}
+	if cfg.SMTPHost != "" {
+		if _, err := strconv.ParseUint(cfg.SMTPPort, 10, 16); err != nil {
+			return &ConfigError{"SMTPPort", fmt.Errorf("expected a port number, got %q", cfg.SMTPPort)}
+		}
+		if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+			return &ConfigError{"SMTPFrom", fmt.Errorf("expected an email address, got %q", cfg.SMTPFrom)}
+		}
+	}
+	if cfg.VAPIDSubject != "" && !strings.HasPrefix(cfg.VAPIDSubject, "mailto:") &&
+		!strings.HasPrefix(cfg.VAPIDSubject, "https:") {
+		return &ConfigError{"VAPIDSubject", errors.New("must be a mailto: or https: URL")}
+	}
+	if cfg.RetentionAction != RetentionAnonymise && cfg.RetentionAction != RetentionDelete {
+		return &ConfigError{"RetentionAction", fmt.Errorf("expected %s or %s, got %q",
+			RetentionAnonymise, RetentionDelete, cfg.RetentionAction)}
+	}
+	for _, cidr := range cfg.MetricsAllowedIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return &ConfigError{"MetricsAllowedIPs", fmt.Errorf("expected a network in CIDR notation, got %q", cidr)}
+		}
+	}
+	for _, cidr := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return &ConfigError{"TrustedProxies", fmt.Errorf("expected a network in CIDR notation, got %q", cidr)}
+		}
+	}
+	defaultLimits := DefaultRateLimits()
+	for route, limits := range cfg.RateLimits {
+		if _, ok := defaultLimits[route]; !ok {
+			return &ConfigError{"RateLimits", fmt.Errorf("can't limit %q, only %s", route, strings.Join(rateLimitedRoutes(), ", "))}
+		}
+		if (limits.PerIP.PerMinute > 0 && limits.PerIP.Burst == 0) ||
+			(limits.PerCSid.PerMinute > 0 && limits.PerCSid.Burst == 0) {
+			return &ConfigError{"RateLimits." + route, errors.New("Burst must be at least 1")}
+		}
+		if limits.PerCSid.PerMinute > 0 && defaultLimits[route].PerCSid.PerMinute == 0 {
+			return &ConfigError{"RateLimits." + route, errors.New("PerCSid can't be set, the route doesn't know which student is making the request")}
+		}
+	}
+	if cfg.LogFormat != "json" && cfg.LogFormat != "logfmt" {
+		return &ConfigError{"LogFormat", fmt.Errorf("expected json or logfmt, got %q", cfg.LogFormat)}
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return &ConfigError{"LogLevel", fmt.Errorf("expected debug, info, warn or error, got %q", cfg.LogLevel)}
+	}
+	if err := cfg.Theme.Validate(); err != nil {
+		themeErr := err.(*ConfigError)
+		return &ConfigError{"Theme." + themeErr.Key, themeErr.Err}
+	}
+	return nil
+}
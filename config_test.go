@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"ListenAt": "8888",
+		"AuthSecret": "fromFile",
+		"MaxNumTimesHelped": 3,
+		"Instructors": ["ta1"]
+	}`), 0600))
+	env := map[string]string{
+		"QUEUE_CONFIG":               path,
+		"QUEUE_MAX_NUM_TIMES_HELPED": "4",
+		"QUEUE_PUSH_THRESHOLDS":      "3, 1",
+		"QUEUE_LISTEN_AT":            "9999",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	cfg, args, err := LoadConfig([]string{"-listen-at", "7777", "-log-student-details", "export", "-format", "csv"}, getenv)
+	require.NoError(t, err)
+	require.Equal(t, []string{"export", "-format", "csv"}, args)
+	require.Equal(t, "7777", cfg.ListenAt)             // Flags win over the environment...
+	require.Equal(t, uint(4), cfg.MaxNumTimesHelped)   // ...which wins over the file...
+	require.Equal(t, []string{"ta1"}, cfg.Instructors) // ...which wins over the defaults.
+	require.Equal(t, []uint{3, 1}, cfg.PushThresholds)
+	require.Equal(t, "fromFile", cfg.PseudonymKey)
+	require.True(t, cfg.LogStudentDetails)
+	require.Equal(t, "25", cfg.SMTPPort)
+	require.Equal(t, filepath.Join("data", "persistence.json"), Config{DataDir: "data"}.DataPath("persistence.json"))
+
+	// Errors name the setting at fault.
+	env["QUEUE_MAX_NUM_TIMES_HELPED"] = "lots"
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, `QUEUE_MAX_NUM_TIMES_HELPED: expected a positive whole number, got "lots"`)
+	delete(env, "QUEUE_MAX_NUM_TIMES_HELPED")
+	_, _, err = LoadConfig([]string{"-retention-action", "shred"}, getenv)
+	require.EqualError(t, err, `RetentionAction: expected anonymise or delete, got "shred"`)
+	_, _, err = LoadConfig([]string{"-defer-positions", "0"}, getenv)
+	require.EqualError(t, err, "DeferPositions: must be at least 1, unless DeferMinutes is set")
+	_, _, err = LoadConfig([]string{"-meeting-domains", "https://zoom.us"}, getenv)
+	require.EqualError(t, err, `MeetingDomains: expected a domain name such as zoom.us, got "https://zoom.us"`)
+
+	cfg, _, err = LoadConfig([]string{"-allow-over-limit-when-empty", "-limit-exempt-csids", "r3a1b,r3a2b"}, getenv)
+	require.NoError(t, err)
+	require.True(t, cfg.AllowOverLimitWhenEmpty)
+	require.Equal(t, []string{"r3a1b", "r3a2b"}, cfg.LimitExemptCSids)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"AuthSecret": "x", "CategoryLimits": {"Exam review": 0}}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, `CategoryLimits: expected a category and a limit of at least 1, got "Exam review": 0`)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"MaxNumTimesHelped": "3"}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, "MaxNumTimesHelped: expected uint, got string")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"MaxNumTimesHelpd": 3}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MaxNumTimesHelpd")
+
+	// A config file that was asked for must exist.
+	_, _, err = LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}, getenv)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, "AuthSecret: must be set to a random string")
+	env["QUEUE_AUTH_SECRET"] = "fromEnv"
+	_, _, err = LoadConfig(nil, getenv)
+	require.NoError(t, err)
+}
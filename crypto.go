@@ -1,13 +1,173 @@
 package main
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
 
 func GenerateSecretForCSid(csid string) string {
-	bytes, _ := bcrypt.GenerateFromPassword([]byte(csid+config.AuthSecret), 14)
+	bytes, _ := bcrypt.GenerateFromPassword([]byte(csid+CurrentConfig().AuthSecret), secretCost)
 	return string(bytes)
 }
 
+// The bcrypt cost of the secrets we hand out. Secrets are rejected unless
+// they have it, as bcrypt takes the cost from the secret, and a made-up one
+// with a higher cost could keep the CPU busy for minutes.
+const secretCost = 14
+
 func CheckSecretForCSid(secret string, csid string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(secret), []byte(csid+config.AuthSecret))
+	if cost, err := bcrypt.Cost([]byte(secret)); err != nil || cost != secretCost {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(secret), []byte(csid+CurrentConfig().AuthSecret))
 	return err == nil
 }
+
+// The rest of this file handles the encryption of persistence.json at rest.
+// Encryption is optional: it's turned on by providing a key (see LoadDataKeys).
+
+// A DataKey is an AES-256 key used to encrypt persistence.json.
+type DataKey []byte
+
+// ID returns a short fingerprint of the key, stored next to the ciphertext so
+// that we know which key to decrypt it with.
+func (k DataKey) ID() string {
+	sum := sha256.Sum256(k)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Keys used to encrypt and decrypt persistence.json. dataKeys[0] is the
+// current key, used for writing. The others are old keys, only used to read
+// data that wasn't re-encrypted yet. Empty if encryption is turned off.
+var dataKeys []DataKey
+
+// encryptedStore is the format of persistence.json when encryption is on.
+type encryptedStore struct {
+	KeyID      string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// ParseDataKey decodes a base64-encoded 32 byte key.
+func ParseDataKey(encoded string) (DataKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption keys must be 32 bytes, base64-encoded")
+	}
+	return key, nil
+}
+
+// GenerateDataKey returns a new random key, base64-encoded.
+func GenerateDataKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatal("Couldn't generate a random key.", "error", err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// LoadDataKeys returns the keys configured in cfg. The current key is read
+// from the QUEUE_ENCRYPTION_KEY environment variable or, if that's not set,
+// from cfg.EncryptionKeyFile. Returns no keys if neither is set.
+func LoadDataKeys(cfg Config) ([]DataKey, error) {
+	encoded := os.Getenv("QUEUE_ENCRYPTION_KEY")
+	if encoded == "" && cfg.EncryptionKeyFile != "" {
+		contents, err := ioutil.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(contents)
+	}
+	if encoded == "" {
+		if len(cfg.OldEncryptionKeyFiles) > 0 {
+			return nil, errors.New("old encryption keys are configured, but there is no current key")
+		}
+		return nil, nil
+	}
+	current, err := ParseDataKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	keys := []DataKey{current}
+	for _, path := range cfg.OldEncryptionKeyFiles {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		old, err := ParseDataKey(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, old)
+	}
+	return keys, nil
+}
+
+// SealStore encrypts the contents of persistence.json with the current key.
+// Returns plaintext unchanged if encryption is turned off.
+func SealStore(plaintext []byte) ([]byte, error) {
+	if len(dataKeys) == 0 {
+		return plaintext, nil
+	}
+	gcm, err := newStoreCipher(dataKeys[0])
+	if err != nil {
+		return nil, err
+	}
+	store := encryptedStore{KeyID: dataKeys[0].ID(), Nonce: make([]byte, gcm.NonceSize())}
+	if _, err := rand.Read(store.Nonce); err != nil {
+		return nil, err
+	}
+	store.Ciphertext = gcm.Seal(nil, store.Nonce, plaintext, []byte(store.KeyID))
+	return json.Marshal(store)
+}
+
+// encryptedStorePrefix is how every encrypted persistence.json starts, as
+// encoding/json writes fields in order.
+const encryptedStorePrefix = `{"KeyID":`
+
+// OpenStore returns the plaintext contents of persistence.json. Files written
+// before encryption was turned on are returned unchanged.
+func OpenStore(contents []byte) ([]byte, error) {
+	if !bytes.HasPrefix(contents, []byte(encryptedStorePrefix)) {
+		return contents, nil
+	}
+	store := encryptedStore{}
+	if err := json.Unmarshal(contents, &store); err != nil {
+		return nil, errors.New("the encrypted data is corrupted")
+	}
+	for _, key := range dataKeys {
+		if key.ID() != store.KeyID {
+			continue
+		}
+		gcm, err := newStoreCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := gcm.Open(nil, store.Nonce, store.Ciphertext, []byte(store.KeyID))
+		if err != nil {
+			return nil, errors.New("the data was tampered with, or is corrupted")
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("the data is encrypted with key %s, which is not configured", store.KeyID)
+}
+
+func newStoreCipher(key DataKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestStoreEncryption(t *testing.T) {
+	defer func(saved []DataKey) { dataKeys = saved }(dataKeys)
+	plaintext := []byte(`{"Entries":[{"CSid":"r3a1b","Name":"Joe Student"}]}`)
+
+	// Without a key, the store is written and read as is.
+	dataKeys = nil
+	sealed, err := SealStore(plaintext)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, sealed)
+
+	oldKey, err := ParseDataKey(GenerateDataKey())
+	require.NoError(t, err)
+	dataKeys = []DataKey{oldKey}
+	sealed, err = SealStore(plaintext)
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "Joe Student")
+	opened, err := OpenStore(sealed)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, opened)
+
+	// Stores written before encryption was turned on can still be read.
+	opened, err = OpenStore(plaintext)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, opened)
+
+	// After rotating, the old key only decrypts.
+	newKey, _ := ParseDataKey(GenerateDataKey())
+	dataKeys = []DataKey{newKey, oldKey}
+	opened, err = OpenStore(sealed)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, opened)
+	resealed, err := SealStore(opened)
+	require.NoError(t, err)
+	dataKeys = []DataKey{newKey}
+	_, err = OpenStore(sealed)
+	require.Error(t, err)
+	opened, err = OpenStore(resealed)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, opened)
+
+	// Tampering is detected.
+	store := encryptedStore{}
+	require.NoError(t, json.Unmarshal(resealed, &store))
+	store.Ciphertext[0] ^= 1
+	tampered, _ := json.Marshal(store)
+	_, err = OpenStore(tampered)
+	require.Error(t, err)
+	_, err = OpenStore(resealed[:len(resealed)/2])
+	require.Error(t, err)
+
+	_, err = ParseDataKey("dG9vIHNob3J0")
+	require.Error(t, err)
+}
+
+func TestCheckSecretCost(t *testing.T) {
+	secret := GenerateSecretForCSid("r3a1b")
+	require.True(t, CheckSecretForCSid(secret, "r3a1b"))
+	require.False(t, CheckSecretForCSid(secret, "r3a2b"))
+
+	// Secrets with another cost are rejected without checking them, however
+	// long that would take.
+	cheap, err := bcrypt.GenerateFromPassword([]byte("r3a1b"+CurrentConfig().AuthSecret), bcrypt.MinCost)
+	require.NoError(t, err)
+	require.False(t, CheckSecretForCSid(string(cheap), "r3a1b"))
+	require.False(t, CheckSecretForCSid("$2a$31$"+string(cheap[7:]), "r3a1b"))
+	require.False(t, CheckSecretForCSid("", "r3a1b"))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the email notifier, which lets students step away from
+// the lab while they wait. Students who opt in on the join form get an email
+// when they get close to the front of the queue, and another one when a TA
+// claims them. Students who book an appointment get a confirmation, with
+// the appointment attached for their calendar.
+
+// EmailNotifier sends queue notifications over SMTP.
+type EmailNotifier struct {
+	Addr     string    // host:port of the SMTP server.
+	Auth     smtp.Auth // nil if the server does not require authentication.
+	From     string
+	Position uint // Students are emailed once at most this many students are ahead of them.
+
+	mutex  sync.Mutex
+	warned map[string]bool // CSids that were already told they are close to the front.
+}
+
+// NewEmailNotifier returns an EmailNotifier that uses the SMTP settings in cfg.
+func NewEmailNotifier(cfg Config) *EmailNotifier {
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return &EmailNotifier{
+		Addr:     net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		Auth:     auth,
+		From:     cfg.SMTPFrom,
+		Position: cfg.EmailAtPosition,
+		warned:   map[string]bool{},
+	}
+}
+
+// Notify implements Notifier.
+func (n *EmailNotifier) Notify(event QueueEvent) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch event.Kind {
+	case EventServed:
+		delete(n.warned, event.Entry.CSid)
+		if event.Entry.Email != "" {
+			locale := event.Entry.Locale
+			subject := Translate(locale, "A TA is on the way")
+			text := claimText(locale, event.Entry)
+			if event.Entry.SessionID != 0 {
+				subject = Translate(locale, "You've been pulled into a group session")
+				text = groupSessionText(locale, event.Session)
+			}
+			n.send(event.Entry.Email, subject, Translate(locale, "Hi %s,", event.Entry.Name)+"\r\n\r\n"+text+"\r\n")
+		}
+	case EventNoShow:
+		// They'll be warned again as they come back up the queue.
+		delete(n.warned, event.Entry.CSid)
+		if event.Entry.Email != "" {
+			locale := event.Entry.Locale
+			n.send(event.Entry.Email, Translate(locale, "A TA couldn't find you"),
+				Translate(locale, "Hi %s,", event.Entry.Name)+"\r\n\r\n"+
+					Translate(locale, "A TA came by, but you weren't there, so others will go ahead of you. Please head back to the lab.")+"\r\n")
+		}
+	case EventDropped:
+		delete(n.warned, event.Entry.CSid)
+		if event.Entry.Email != "" {
+			locale := event.Entry.Locale
+			n.send(event.Entry.Email, Translate(locale, "You missed your turn"),
+				Translate(locale, "Hi %s,", event.Entry.Name)+"\r\n\r\n"+
+					Translate(locale, "A TA couldn't find you %d times, so you were taken off the queue. You can join it again if you still need help.", event.Entry.NoShows)+"\r\n")
+		}
+	case EventLeft, EventRemoved, EventMerged, EventSnoozed:
+		delete(n.warned, event.Entry.CSid)
+	case EventBooked:
+		if booking := event.Booking; booking.Email != "" {
+			locale := booking.Locale
+			n.sendWithAttachment(booking.Email, Translate(locale, "Your appointment is booked"),
+				Translate(locale, "Hi %s,", booking.Name)+"\r\n\r\n"+
+					Translate(locale, "Your appointment is booked for %s. You will be at the front of the queue when it starts, so please be there on time.",
+						booking.Start.Format(appointmentTimeLayout))+"\r\n",
+				"appointment.ics", "text/calendar; charset=UTF-8; method=PUBLISH",
+				BookingICS(booking, CurrentTheme(DefaultQueueID).CourseName))
+		}
+	case EventBookingCancelled:
+		if booking := event.Booking; booking.Email != "" {
+			locale := booking.Locale
+			n.send(booking.Email, Translate(locale, "Your appointment was cancelled"),
+				Translate(locale, "Hi %s,", booking.Name)+"\r\n\r\n"+
+					Translate(locale, "We are sorry, but your TA is no longer available for your appointment at %s. Please book another one, or join the queue.",
+						booking.Start.Format(appointmentTimeLayout))+"\r\n")
+		}
+	}
+	for position, entry := range event.Waiting {
+		if uint(position) > n.Position {
+			break
+		}
+		if entry.Email == "" || n.warned[entry.CSid] || entry.IsDeferred(time.Now()) {
+			continue
+		}
+		n.warned[entry.CSid] = true
+		n.send(entry.Email, Translate(entry.Locale, "You're almost at the front of the queue"),
+			Translate(entry.Locale, "Hi %s,", entry.Name)+"\r\n\r\n"+studentsAhead(entry.Locale, position)+"\r\n")
+	}
+}
+
+// studentsAhead tells a student how many students are ahead of them, and to
+// come back.
+func studentsAhead(locale string, position int) string {
+	switch position {
+	case 0:
+		return Translate(locale, "You are at the front of the queue. "+
+			"Please make your way back to the lab so that you don't miss your turn.")
+	case 1:
+		return Translate(locale, "There is 1 student ahead of you in the queue. "+
+			"Please make your way back to the lab so that you don't miss your turn.")
+	}
+	return Translate(locale, "There are %d students ahead of you in the queue. "+
+		"Please make your way back to the lab so that you don't miss your turn.", position)
+}
+
+// send delivers a plain text email.
+func (n *EmailNotifier) send(to string, subject string, body string) {
+	n.deliver(to, subject, "text/plain; charset=UTF-8", body)
+}
+
+// sendWithAttachment delivers a plain text email, with a file called name
+// of the given content type attached.
+func (n *EmailNotifier) sendWithAttachment(to string, subject string, body string, name string, contentType string, attachment string) {
+	var parts bytes.Buffer
+	writer := multipart.NewWriter(&parts)
+	text, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	_, _ = text.Write([]byte(body))
+	file, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {`attachment; filename="` + name + `"`},
+	})
+	_, _ = file.Write([]byte(attachment))
+	_ = writer.Close()
+	n.deliver(to, subject, "multipart/mixed; boundary="+writer.Boundary(), parts.String())
+}
+
+// deliver sends an email with a body of the given content type. Errors are
+// logged, as there is nobody to report them to.
+func (n *EmailNotifier) deliver(to string, subject string, contentType string, body string) {
+	header := []string{
+		"From: " + n.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: " + contentType,
+	}
+	msg := strings.Join(header, "\r\n") + "\r\n\r\n" + body
+	// From can include a display name, which doesn't belong in the envelope.
+	sender := n.From
+	if address, err := mail.ParseAddress(n.From); err == nil {
+		sender = address.Address
+	}
+	err := smtp.SendMail(n.Addr, n.Auth, sender, []string{to}, []byte(msg))
+	if err != nil {
+		slog.Warn("Couldn't send email notification.", "email", to, "error", err)
+	}
+}
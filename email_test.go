@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeSMTPServer runs a minimal SMTP server on localhost, which accepts
+// every message and forwards its body to the returned channel.
+func startFakeSMTPServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, messages)
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func serveFakeSMTP(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	_ = text.PrintfLine("220 localhost fake SMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO", "HELO":
+			_ = text.PrintfLine("250 localhost")
+		case "DATA":
+			_ = text.PrintfLine("354 go ahead")
+			body, err := bufio.NewReader(text.DotReader()).ReadString(0)
+			if err != nil && body == "" {
+				return
+			}
+			messages <- body
+			_ = text.PrintfLine("250 queued")
+		case "QUIT":
+			_ = text.PrintfLine("221 bye")
+			return
+		default:
+			_ = text.PrintfLine("250 ok")
+		}
+	}
+}
+
+func receiveEmail(t *testing.T, messages <-chan string) string {
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No email was received")
+		return ""
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	addr, messages := startFakeSMTPServer(t)
+	notifier := &EmailNotifier{Addr: addr, From: "queue@example.com", Position: 1, warned: map[string]bool{}}
+
+	first := QueueEntry{CSid: "r3a1b", Name: "Joe Student"}
+	second := QueueEntry{CSid: "r3a2b", Name: "Diligent Student", Email: "diligent@example.com"}
+	third := QueueEntry{CSid: "r3a3b", Name: "Late Student", Email: "late@example.com"}
+
+	// The second student is close enough to the front, the third one is not.
+	notifier.Notify(QueueEvent{Kind: EventJoined, Entry: third, Waiting: []QueueEntry{first, second, third}})
+	msg := receiveEmail(t, messages)
+	require.Contains(t, msg, "To: diligent@example.com")
+	require.Contains(t, msg, "There is 1 student ahead of you")
+	require.Contains(t, msg, "Subject: You're almost at the front of the queue\n")
+
+	// Nobody should get the same reminder twice.
+	served := first
+	served.WasServed = true
+	notifier.Notify(QueueEvent{Kind: EventServed, Entry: served, Waiting: []QueueEntry{second, third}})
+	msg = receiveEmail(t, messages)
+	require.Contains(t, msg, "To: late@example.com")
+
+	served = second
+	served.WasServed = true
+	notifier.Notify(QueueEvent{Kind: EventServed, Entry: served, Waiting: []QueueEntry{third}})
+	msg = receiveEmail(t, messages)
+	require.Contains(t, msg, "To: diligent@example.com")
+	require.Contains(t, msg, "A TA is on the way")
+	select {
+	case msg := <-messages:
+		t.Fatal("Unexpected email:", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEmailSubjectEncoding(t *testing.T) {
+	useCatalogues(t)
+	addr, messages := startFakeSMTPServer(t)
+	notifier := &EmailNotifier{Addr: addr, From: "queue@example.com", Position: 1, warned: map[string]bool{}}
+
+	// Headers are ASCII, so translated subjects are encoded.
+	first := QueueEntry{CSid: "r3a1b", Name: "Joe Student"}
+	second := QueueEntry{CSid: "r3a2b", Name: "Diligent Student", Email: "diligent@example.com", Locale: "fr"}
+	notifier.Notify(QueueEvent{Kind: EventJoined, Entry: second, Waiting: []QueueEntry{first, second}})
+	msg := receiveEmail(t, messages)
+	require.Contains(t, msg, "Subject: =?utf-8?q?Vous_=C3=AAtes_presque_en_t=C3=AAte_de_la_file?=\n")
+	require.Contains(t, msg, "Il y a 1 étudiant avant vous dans la file.")
+	header, _, _ := strings.Cut(msg, "\n\n")
+	for _, r := range header {
+		require.Less(t, r, rune(128))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// This file contains the CSV and NDJSON (newline-delimited JSON) exports of
+// the ticket history, used both by /export and by the export subcommand.
+// Unlike /jsondump, the exports only contain tickets, and their columns are
+// stable: new columns may be added, existing ones won't change meaning.
+
+// An exportColumn extracts one value from a ticket. Times are formatted as
+// RFC 3339 strings, and are empty when they don't apply.
+type exportColumn func(entry QueueEntry) interface{}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+var exportColumns = map[string]exportColumn{
+	"csid":      func(e QueueEntry) interface{} { return e.CSid },
+	"name":      func(e QueueEntry) interface{} { return e.Name },
+	"task":      func(e QueueEntry) interface{} { return e.TaskInfo },
+	"joined_at": func(e QueueEntry) interface{} { return formatExportTime(e.JoinedAt) },
+	"served_at": func(e QueueEntry) interface{} {
+		if !e.WasServed || e.LeftEarly {
+			return ""
+		}
+		return formatExportTime(e.ServedAt)
+	},
+	"left_at": func(e QueueEntry) interface{} {
+		if !e.LeftEarly {
+			return ""
+		}
+		return formatExportTime(e.ServedAt)
+	},
+	"served_by":  func(e QueueEntry) interface{} { return e.ServedBy },
+	"was_served": func(e QueueEntry) interface{} { return e.WasServed && !e.LeftEarly },
+	"left_early": func(e QueueEntry) interface{} { return e.LeftEarly },
+	"wait_seconds": func(e QueueEntry) interface{} {
+		if !e.WasServed || e.LeftEarly {
+			return nil
+		}
+		return int(e.ServedAt.Sub(e.JoinedAt).Seconds())
+	},
+	"id":             func(e QueueEntry) interface{} { return e.ID },
+	"removed_at":     func(e QueueEntry) interface{} { return formatExportTime(e.RemovedAt) },
+	"removed_by":     func(e QueueEntry) interface{} { return e.RemovedBy },
+	"removal_reason": func(e QueueEntry) interface{} { return e.RemovalReason },
+	"merged_into": func(e QueueEntry) interface{} {
+		if e.MergedInto == 0 {
+			return nil
+		}
+		return e.MergedInto
+	},
+	"no_shows":           func(e QueueEntry) interface{} { return e.NoShows },
+	"dropped_as_no_show": func(e QueueEntry) interface{} { return e.DroppedAsNoShow },
+	"location":           func(e QueueEntry) interface{} { return e.Where.Location },
+	"meeting_url":        func(e QueueEntry) interface{} { return e.Where.MeetingURL },
+	"category":           func(e QueueEntry) interface{} { return e.Category },
+	"lab_section":        func(e QueueEntry) interface{} { return e.LabSection },
+	"session_id": func(e QueueEntry) interface{} {
+		if e.SessionID == 0 {
+			return nil
+		}
+		return e.SessionID
+	},
+}
+
+// DefaultExportColumns is the order columns are exported in when none are selected.
+var DefaultExportColumns = []string{
+	"csid", "name", "task", "joined_at", "served_at", "left_at", "served_by", "was_served", "left_early",
+	"wait_seconds", "id", "removed_at", "removed_by", "removal_reason", "merged_into",
+	"no_shows", "dropped_as_no_show", "session_id", "location", "meeting_url",
+	"category", "lab_section",
+}
+
+// Columns that identify a student even when CSids are pseudonymised. Tasks
+// and removal reasons are written by students and TAs, and often name them.
+var identifyingExportColumns = map[string]bool{"name": true, "meeting_url": true, "task": true, "removal_reason": true}
+
+// ExportOptions selects what goes into an export.
+type ExportOptions struct {
+	Format       string    // "csv" or "ndjson".
+	Columns      []string  // See DefaultExportColumns for the available ones.
+	From         time.Time // Only tickets created in [From, To) are exported.
+	To           time.Time
+	Pseudonymise bool   // Replace CSids with a keyed hash of themselves.
+	PseudonymKey string // Key for the hash. Keep it secret, CSids are easy to guess.
+}
+
+// ParseExportColumns splits a comma-separated list of column names, and
+// checks that they exist. An empty list selects DefaultExportColumns.
+func ParseExportColumns(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return DefaultExportColumns, nil
+	}
+	var columns []string
+	for _, column := range strings.Split(list, ",") {
+		column = strings.TrimSpace(column)
+		if _, ok := exportColumns[column]; !ok {
+			return nil, fmt.Errorf("unknown column %q, available columns are %s",
+				column, strings.Join(DefaultExportColumns, ", "))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// Pseudonym returns a stable pseudonym for the given CSid. The same CSid
+// and key always produce the same pseudonym, so that research data can be
+// linked across exports without revealing who the students are.
+func Pseudonym(CSid string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(CSid))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// WriteExport writes the tickets in entries that match opts to w.
+func WriteExport(w io.Writer, entries []QueueEntry, opts ExportOptions) error {
+	if opts.Pseudonymise {
+		if opts.PseudonymKey == "" {
+			return fmt.Errorf("a key is needed to pseudonymise CSids")
+		}
+		for _, column := range opts.Columns {
+			if identifyingExportColumns[column] {
+				return fmt.Errorf("column %q can't be exported with pseudonymised CSids", column)
+			}
+		}
+	}
+	var csvWriter *csv.Writer
+	var jsonEncoder *json.Encoder
+	switch opts.Format {
+	case "csv":
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(opts.Columns); err != nil {
+			return err
+		}
+	case "ndjson":
+		jsonEncoder = json.NewEncoder(w)
+	default:
+		return fmt.Errorf("unknown format %q, expected csv or ndjson", opts.Format)
+	}
+
+	for _, entry := range entries {
+		if entry.JoinedAt.Before(opts.From) || !entry.JoinedAt.Before(opts.To) {
+			continue
+		}
+		if opts.Pseudonymise && !entry.Anonymised {
+			entry.CSid = Pseudonym(entry.CSid, opts.PseudonymKey)
+		}
+		if csvWriter != nil {
+			record := make([]string, len(opts.Columns))
+			for i, column := range opts.Columns {
+				if value := exportColumns[column](entry); value != nil {
+					record[i] = fmt.Sprint(value)
+				}
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+		} else {
+			object := map[string]interface{}{}
+			for _, column := range opts.Columns {
+				object[column] = exportColumns[column](entry)
+			}
+			if err := jsonEncoder.Encode(object); err != nil {
+				return err
+			}
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return nil
+}
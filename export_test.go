@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteExport(t *testing.T) {
+	joined := time.Date(2019, time.March, 4, 10, 0, 0, 0, time.UTC)
+	entries := []QueueEntry{
+		{CSid: "r3a1b", Name: "Joe Student", TaskInfo: "Lost, again", JoinedAt: joined,
+			WasServed: true, ServedAt: joined.Add(90 * time.Second), ServedBy: "ta1"},
+		{CSid: "r3a2b", Name: "Diligent Student", JoinedAt: joined.Add(time.Minute),
+			WasServed: true, ServedAt: joined.Add(2 * time.Minute), LeftEarly: true},
+		{CSid: "r3a3b", Name: "Late Student", JoinedAt: joined.AddDate(0, 0, 1)},
+		{ID: 4, CSid: "r3a4b", JoinedAt: joined.Add(3 * time.Minute), Removed: true,
+			RemovedAt: joined.Add(4 * time.Minute), RemovedBy: "ta1", MergedInto: 2},
+	}
+	columns, err := ParseExportColumns("csid, task,served_at,wait_seconds,removed_by,merged_into")
+	require.NoError(t, err)
+	opts := ExportOptions{Format: "csv", Columns: columns, From: joined, To: joined.Add(time.Hour)}
+
+	var out bytes.Buffer
+	require.NoError(t, WriteExport(&out, entries, opts))
+	require.Equal(t, "csid,task,served_at,wait_seconds,removed_by,merged_into\n"+
+		"r3a1b,\"Lost, again\",2019-03-04T10:01:30Z,90,,\n"+
+		"r3a2b,,,,,\n"+
+		"r3a4b,,,,ta1,2\n", out.String())
+
+	out.Reset()
+	opts.Format = "ndjson"
+	opts.Pseudonymise = true
+	opts.PseudonymKey = "key"
+	require.Error(t, WriteExport(&out, entries, opts))
+	opts.Columns = []string{"csid", "served_at", "wait_seconds", "removed_by", "merged_into"}
+	require.NoError(t, WriteExport(&out, entries, opts))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	require.JSONEq(t, `{"csid": "`+Pseudonym("r3a1b", "key")+`",
+		"served_at": "2019-03-04T10:01:30Z", "wait_seconds": 90, "removed_by": "", "merged_into": null}`, lines[0])
+	require.NotContains(t, out.String(), "r3a1b")
+
+	// Anonymised tickets already hold the pseudonym, so it matches the
+	// pseudonyms of tickets that haven't been anonymised yet.
+	out.Reset()
+	anonymised := []QueueEntry{{CSid: Pseudonym("r3a1b", "key"), JoinedAt: joined, Anonymised: true}}
+	require.NoError(t, WriteExport(&out, anonymised, opts))
+	require.Contains(t, out.String(), `"csid":"`+Pseudonym("r3a1b", "key")+`"`)
+
+	opts.Columns = []string{"csid", "name"}
+	require.Error(t, WriteExport(&out, entries, opts))
+	_, err = ParseExportColumns("csid,password")
+	require.Error(t, err)
+
+	// Every default column can be exported.
+	opts = ExportOptions{Format: "csv", Columns: DefaultExportColumns, From: joined, To: joined.Add(time.Hour)}
+	out.Reset()
+	require.NoError(t, WriteExport(&out, entries, opts))
+	require.Equal(t, strings.Join(DefaultExportColumns, ","), strings.SplitN(out.String(), "\n", 2)[0])
+}
+
+func TestDefaultExportColumns(t *testing.T) {
+	// Every column can be exported, and is exported by default.
+	require.Len(t, DefaultExportColumns, len(exportColumns))
+	for _, column := range DefaultExportColumns {
+		require.Contains(t, exportColumns, column)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// This file contains the health checks used by load balancers and process
+// managers, and the graceful shutdown of the web server.
+
+// How long in-flight requests have to finish once we are asked to stop.
+const shutdownTimeout = 30 * time.Second
+
+// How old the Classy roster can get before we report it as stale.
+const rosterMaxAge = 24 * time.Hour
+
+// Set to 1 once we start shutting down, so that /readyz fails and load
+// balancers stop sending us traffic.
+var shuttingDown int32
+
+// Readiness is what /readyz reports.
+type Readiness struct {
+	Ready  bool
+	Store  string // One of the Store* constants in persistence.go.
+	Roster string // "not loaded", "fresh" or "stale".
+}
+
+// CheckReadiness returns whether we can serve traffic: the store must have
+// loaded (or been created from scratch), the Classy roster, if it is used,
+// must be fresh, and we must not be shutting down.
+func CheckReadiness(now time.Time) Readiness {
+	r := Readiness{Store: storeStatus, Roster: "not loaded"}
+	if !rosterLoadedAt.IsZero() {
+		r.Roster = "fresh"
+		if now.Sub(rosterLoadedAt) > rosterMaxAge {
+			r.Roster = "stale"
+		}
+	}
+	r.Ready = (r.Store == StoreLoaded || r.Store == StoreNew) &&
+		r.Roster != "stale" &&
+		atomic.LoadInt32(&shuttingDown) == 0
+	return r
+}
+
+// ServeUntilSignalled serves HTTP requests with handler until we get SIGTERM
+// or SIGINT. Then it stops accepting connections, waits for in-flight
+// requests to finish, and writes the queue to disk one last time.
+func ServeUntilSignalled(addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down.", "signal", sig.String())
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Some requests didn't finish in time.", "error", err)
+	}
+	// Every write to the store happens with the mutex held, so once we hold
+	// it nothing is half-written. We keep it, so that background jobs can't
+	// start another write before we exit.
+	queue.Mutex.Lock()
+	return UpdateDiskCopy()
+}
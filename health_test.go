@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	defer func(saved string) { storeStatus = saved }(storeStatus)
+	defer func(saved time.Time) { rosterLoadedAt = saved }(rosterLoadedAt)
+	now := time.Now()
+
+	storeStatus = StoreNotLoaded
+	require.False(t, CheckReadiness(now).Ready)
+	storeStatus = StoreCorrupted
+	require.False(t, CheckReadiness(now).Ready)
+	storeStatus = StoreLoaded
+	require.Equal(t, Readiness{Ready: true, Store: StoreLoaded, Roster: "not loaded"}, CheckReadiness(now))
+
+	rosterLoadedAt = now.Add(-time.Hour)
+	require.True(t, CheckReadiness(now).Ready)
+	rosterLoadedAt = now.Add(-2 * rosterMaxAge)
+	require.Equal(t, "stale", CheckReadiness(now).Roster)
+	require.False(t, CheckReadiness(now).Ready)
+
+	rosterLoadedAt = time.Time{}
+	atomic.StoreInt32(&shuttingDown, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	require.False(t, CheckReadiness(now).Ready)
+}
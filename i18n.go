@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"io/fs"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file translates the web interface, emails and push notifications.
+// As with gettext, messages are looked up by their English text in a
+// catalogue for each language: locales/fr.json maps English messages to
+// French ones. Messages missing from a catalogue are shown in English.
+// Messages can contain fmt verbs, which are filled in after translating.
+
+// A Catalogue maps English messages to their translation.
+type Catalogue map[string]string
+
+// The language of the messages in the code and templates.
+const DefaultLocale = "en"
+
+// The catalogues in use, by locale. Set once when the server starts.
+var catalogues = map[string]Catalogue{DefaultLocale: {}}
+
+// The cookie remembering the language a user picked.
+const localeCookie = "queue-lang"
+
+// The key of the locale in the gin context.
+const localeKey = "locale"
+
+// LoadCatalogues reads every catalogue in fsys. Translations must use as
+// many fmt verbs as their message.
+func LoadCatalogues(fsys fs.FS) (map[string]Catalogue, error) {
+	names, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]Catalogue{DefaultLocale: {}}
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		catalogue := Catalogue{}
+		if err := json.Unmarshal(contents, &catalogue); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		for msgid, translation := range catalogue {
+			if translation != "" && countVerbs(translation) != countVerbs(msgid) {
+				return nil, fmt.Errorf("%s: the translation of %q doesn't use the same values", name, msgid)
+			}
+		}
+		loaded[strings.ToLower(strings.TrimSuffix(name, ".json"))] = catalogue
+	}
+	return loaded, nil
+}
+
+// countVerbs returns how many fmt verbs s contains.
+func countVerbs(s string) int {
+	return strings.Count(s, "%") - 2*strings.Count(s, "%%")
+}
+
+// Translate returns the translation of msgid, formatted with args if any.
+func Translate(locale string, msgid string, args ...interface{}) string {
+	msg := msgid
+	if translation := catalogues[locale][msgid]; translation != "" {
+		msg = translation
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// TranslateHTML is like Translate, for messages containing HTML markup.
+// args are escaped, but the messages themselves are trusted.
+func TranslateHTML(locale string, msgid string, args ...interface{}) template.HTML {
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		escaped[i] = template.HTMLEscapeString(fmt.Sprint(arg))
+	}
+	return template.HTML(Translate(locale, msgid, escaped...))
+}
+
+// Locales returns the available locales, sorted.
+func Locales() []string {
+	locales := []string{}
+	for locale := range catalogues {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// LanguageName returns the name of the language of locale, in that language.
+// Catalogues give it as the translation of "English".
+func LanguageName(locale string) string {
+	return Translate(locale, "English")
+}
+
+// The formats of relative times, see RelativeTime. Tickets are rarely more
+// than a few hours old, so days are as far as we go.
+var relativeTimes = []humanize.RelTimeMagnitude{
+	{D: time.Minute, Format: "just now", DivBy: 1},
+	{D: 2 * time.Minute, Format: "1 minute ago", DivBy: 1},
+	{D: time.Hour, Format: "%d minutes ago", DivBy: time.Minute},
+	{D: 2 * time.Hour, Format: "1 hour ago", DivBy: 1},
+	{D: humanize.Day, Format: "%d hours ago", DivBy: time.Hour},
+	{D: 2 * humanize.Day, Format: "1 day ago", DivBy: 1},
+	{D: math.MaxInt64, Format: "%d days ago", DivBy: humanize.Day},
+}
+
+// RelativeTime describes how long ago then was, e.g. "5 minutes ago".
+func RelativeTime(locale string, then time.Time) string {
+	magnitudes := make([]humanize.RelTimeMagnitude, len(relativeTimes))
+	for i, magnitude := range relativeTimes {
+		magnitude.Format = Translate(locale, magnitude.Format)
+		magnitudes[i] = magnitude
+	}
+	return humanize.CustomRelTime(then, time.Now(), "", "", magnitudes)
+}
+
+// TimeUntil describes how long it is until then, rounded up so that it
+// has come by the time given, e.g. "in 5 minutes".
+func TimeUntil(locale string, then time.Time) string {
+	wait := time.Until(then)
+	switch {
+	case wait <= time.Minute:
+		return Translate(locale, "in a minute")
+	case wait <= time.Hour:
+		return Translate(locale, "in %d minutes", int(math.Ceil(wait.Minutes())))
+	case wait <= 2*humanize.Day:
+		return Translate(locale, "in %d hours", int(math.Ceil(wait.Hours())))
+	}
+	return Translate(locale, "in %d days", int(math.Ceil(wait.Hours()/24)))
+}
+
+// NegotiateLocale returns the available locale that best matches an
+// Accept-Language header, or DefaultLocale.
+func NegotiateLocale(acceptLanguage string) string {
+	type preference struct {
+		tag     string
+		quality float64
+	}
+	preferences := []preference{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		pref := preference{tag: strings.ToLower(strings.TrimSpace(fields[0])), quality: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					pref.quality = q
+				}
+			}
+		}
+		if pref.tag != "" && pref.tag != "*" && pref.quality > 0 {
+			preferences = append(preferences, pref)
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].quality > preferences[j].quality })
+	for _, pref := range preferences {
+		// fr-CA is served with fr.
+		for _, tag := range []string{pref.tag, strings.SplitN(pref.tag, "-", 2)[0]} {
+			if _, ok := catalogues[tag]; ok {
+				return tag
+			}
+		}
+	}
+	return DefaultLocale
+}
+
+// Localise picks the language of every request: the one the user chose
+// with /language if any, and the one their browser asks for otherwise.
+func Localise() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		locale := NegotiateLocale(c.GetHeader("Accept-Language"))
+		if chosen, err := c.Cookie(localeCookie); err == nil {
+			if _, ok := catalogues[chosen]; ok {
+				locale = chosen
+			}
+		}
+		c.Set(localeKey, locale)
+		c.Header("Content-Language", locale)
+		c.Header("Vary", "Accept-Language, Cookie")
+	}
+}
+
+// Locale returns the language of the request, see Localise.
+func Locale(c *gin.Context) string {
+	if locale := c.GetString(localeKey); locale != "" {
+		return locale
+	}
+	return DefaultLocale
+}
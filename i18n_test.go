@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// useCatalogues loads the embedded catalogues for the rest of the test.
+func useCatalogues(t *testing.T) {
+	loaded, err := LoadCatalogues(AssetFS("locales", ""))
+	require.NoError(t, err)
+	saved := catalogues
+	catalogues = loaded
+	t.Cleanup(func() { catalogues = saved })
+}
+
+func TestTranslate(t *testing.T) {
+	useCatalogues(t)
+	require.Equal(t, []string{"en", "fr"}, Locales())
+	require.Equal(t, "Français", LanguageName("fr"))
+	require.Equal(t, "Erased 3 tickets and 1 appointments.", Translate("en", "Erased %d tickets and %d appointments.", 3, 1))
+	require.Equal(t, "3 tickets et 1 rendez-vous effacés.", Translate("fr", "Erased %d tickets and %d appointments.", 3, 1))
+	require.Equal(t, "Not translated", Translate("fr", "Not translated"))
+	require.Equal(t, "Not translated", Translate("de", "Not translated"))
+	require.Equal(t, "il y a 5 minutes", RelativeTime("fr", time.Now().Add(-5*time.Minute)))
+	require.Equal(t, "1 hour ago", RelativeTime("en", time.Now().Add(-90*time.Minute)))
+	require.Equal(t, `Bienvenue dans la <b>file d'attente de &lt;i&gt;CPSC 210</b>.`,
+		string(TranslateHTML("fr", "Welcome to the <b>%s Queue System</b>.", "<i>CPSC 210")))
+
+	// Translations must keep the values of their message.
+	_, err := LoadCatalogues(fstest.MapFS{"fr.json": {Data: []byte(`{"Erased %d tickets.": "Tickets effacés."}`)}})
+	require.Error(t, err)
+	loaded, err := LoadCatalogues(fstest.MapFS{"fr.json": {Data: []byte(`{"100%% done": "Fini à 100 %"}`)}})
+	require.Error(t, err)
+	loaded, err = LoadCatalogues(fstest.MapFS{"fr.json": {Data: []byte(`{"100%% done, %d left": "%d restants"}`)}})
+	require.NoError(t, err)
+	require.Contains(t, loaded, "fr")
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	useCatalogues(t)
+	require.Equal(t, "en", NegotiateLocale(""))
+	require.Equal(t, "fr", NegotiateLocale("fr-CA,fr;q=0.9,en;q=0.8"))
+	require.Equal(t, "en", NegotiateLocale("de-DE,en;q=0.5,fr;q=0.4"))
+	require.Equal(t, "fr", NegotiateLocale("en;q=0.2, FR;q=0.7"))
+	require.Equal(t, "en", NegotiateLocale("fr;q=0, de"))
+	require.Equal(t, "en", NegotiateLocale("*"))
+}
+
+func TestLocalisedPages(t *testing.T) {
+	useCatalogues(t)
+	hashes, err := StaticHashes(AssetFS("static", ""))
+	require.NoError(t, err)
+	templates, err := LoadTemplates(AssetFS("templates", ""), templateFuncs(hashes))
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Localise())
+	router.SetHTMLTemplate(templates)
+	router.GET("/", handleIndex)
+	router.GET("/status", handleStatus)
+	router.POST("/join", handleJoinReq)
+	router.GET("/language", handleLanguage(router))
+	get := func(method string, url string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(http.MethodGet, "/", http.Header{"Accept-Language": {"fr-CA"}})
+	require.Equal(t, "fr", w.Header().Get("Content-Language"))
+	require.Contains(t, w.Body.String(), `<html lang="fr">`)
+	require.Contains(t, w.Body.String(), "Entrez dans la file ici")
+	require.Contains(t, w.Body.String(), "English</a>")
+	w = get(http.MethodGet, "/", http.Header{})
+	require.Contains(t, w.Body.String(), "Join the queue here")
+	require.Contains(t, w.Body.String(), "Français</a>")
+
+	// Picking a language overrides the browser's, and takes the user back.
+	w = get(http.MethodGet, "/language?lang=fr", http.Header{"Referer": {"http://example.com/status?x=1"}})
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/status?x=1", w.Header().Get("Location"))
+	cookie := w.Header().Get("Set-Cookie")
+	require.Contains(t, cookie, "queue-lang=fr")
+	w = get(http.MethodGet, "/status", http.Header{"Cookie": {cookie}, "Accept-Language": {"en"}})
+	require.Contains(t, w.Body.String(), "Vous n&#39;êtes pas dans la file.")
+	require.Contains(t, w.Body.String(), `status.innerText = "Votre navigateur n'a pas autorisé les notifications."`)
+
+	// Pages that can't be fetched again send the user home.
+	w = get(http.MethodGet, "/language?lang=en", http.Header{"Referer": {"http://example.com/join"}})
+	require.Equal(t, "/", w.Header().Get("Location"))
+	w = get(http.MethodGet, "/language?lang=en", http.Header{"Referer": {"https://elsewhere.example/status"}})
+	require.Equal(t, "/", w.Header().Get("Location"))
+	w = get(http.MethodGet, "/language?lang=xx", http.Header{})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Error messages are translated too.
+	req := httptest.NewRequest(http.MethodPost, "/join", bytes.NewBufferString("name=&csid=a1b2c"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "fr")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Contains(t, w.Body.String(), "Le nom ou l&#39;identifiant CS saisi n&#39;est pas valide.")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// This file contains the limits on how often students can get help, so that
+// everybody gets a chance: MaxNumTimesHelped in 24 hours,
+// MaxTimesHelpedPerWeek in 7 days, CategoryLimits in 24 hours for each
+// category, and HelpCooldownMinutes between being helped and joining again.
+
+// The rules students can be turned away for.
+const (
+	LimitDaily    = "daily"    // MaxNumTimesHelped.
+	LimitWeekly   = "weekly"   // MaxTimesHelpedPerWeek.
+	LimitCategory = "category" // CategoryLimits.
+	LimitCooldown = "cooldown" // HelpCooldownMinutes.
+)
+
+// A HelpLimit is a rule that keeps a student from joining the queue.
+type HelpLimit struct {
+	Rule     string    // One of the Limit* constants.
+	Times    uint      // How many times the student was helped within the rule's period.
+	Category string    // The category the student picked, for LimitCategory.
+	Until    time.Time // When the student can join the queue again.
+}
+
+// helpLimitLocked returns the rule that keeps the student of ticket from
+// joining the queue at now, if any. If the student went over several, it
+// returns the one that lasts the longest, so that they can join again at
+// its Until.
+// The caller of this function should have locked the mutex before calling it.
+func helpLimitLocked(ticket QueueEntry, now time.Time) (HelpLimit, bool) {
+	config := CurrentConfig()
+	for _, CSid := range config.LimitExemptCSids {
+		if CSid == ticket.CSid {
+			return HelpLimit{}, false
+		}
+	}
+	if config.AllowOverLimitWhenEmpty && len(unservedEntriesLocked()) == 0 {
+		return HelpLimit{}, false
+	}
+	var helped, helpedInCategory []time.Time
+	for _, entry := range queue.Entries {
+		if entry.CSid == ticket.CSid && helpedSince(entry, now.AddDate(0, 0, -7)) {
+			helped = append(helped, entry.ServedAt)
+			if ticket.Category != "" && entry.Category == ticket.Category {
+				helpedInCategory = append(helpedInCategory, entry.ServedAt)
+			}
+		}
+	}
+	sort.Slice(helped, func(i, j int) bool { return helped[i].Before(helped[j]) })
+	sort.Slice(helpedInCategory, func(i, j int) bool { return helpedInCategory[i].Before(helpedInCategory[j]) })
+
+	var limits []HelpLimit
+	if limit, over := countLimit(LimitDaily, helped, config.MaxNumTimesHelped, 24*time.Hour, now); over {
+		limits = append(limits, limit)
+	}
+	if limit, over := countLimit(LimitWeekly, helped, config.MaxTimesHelpedPerWeek, 7*24*time.Hour, now); over {
+		limits = append(limits, limit)
+	}
+	if ticket.Category != "" {
+		max := config.CategoryLimits[ticket.Category]
+		if limit, over := countLimit(LimitCategory, helpedInCategory, max, 24*time.Hour, now); over {
+			limit.Category = ticket.Category
+			limits = append(limits, limit)
+		}
+	}
+	if cooldown := time.Duration(config.HelpCooldownMinutes) * time.Minute; cooldown > 0 && len(helped) > 0 {
+		if until := helped[len(helped)-1].Add(cooldown); until.After(now) {
+			limits = append(limits, HelpLimit{Rule: LimitCooldown, Times: 1, Until: until})
+		}
+	}
+
+	if len(limits) == 0 {
+		return HelpLimit{}, false
+	}
+	longest := limits[0]
+	for _, limit := range limits[1:] {
+		if limit.Until.After(longest.Until) {
+			longest = limit
+		}
+	}
+	return longest, true
+}
+
+// countLimit returns whether a student helped at the given times, oldest
+// first, has been helped max times or more within period before now, and
+// if so, when enough of those times will be older than period for them to
+// join again. A max of 0 means there is no limit.
+func countLimit(rule string, helped []time.Time, max uint, period time.Duration, now time.Time) (HelpLimit, bool) {
+	if max == 0 {
+		return HelpLimit{}, false
+	}
+	var recent []time.Time
+	for _, servedAt := range helped {
+		if servedAt.After(now.Add(-period)) {
+			recent = append(recent, servedAt)
+		}
+	}
+	if uint(len(recent)) < max {
+		return HelpLimit{}, false
+	}
+	return HelpLimit{
+		Rule:  rule,
+		Times: uint(len(recent)),
+		Until: recent[uint(len(recent))-max].Add(period),
+	}, true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestHelpLimits(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.MaxNumTimesHelped = 2
+	cfg.MaxTimesHelpedPerWeek = 3
+	cfg.CategoryLimits = map[string]uint{"Exam review": 1}
+	cfg.HelpCooldownMinutes = 20
+	SetConfig(cfg)
+
+	now := time.Now()
+	helpedAgo := func(ago time.Duration, category string) QueueEntry {
+		return QueueEntry{CSid: "r3a1b", Category: category, WasServed: true, ServedAt: now.Add(-ago)}
+	}
+	limit := func(category string) (HelpLimit, bool) {
+		return helpLimitLocked(QueueEntry{CSid: "r3a1b", Category: category}, now)
+	}
+
+	queue.Entries = []QueueEntry{helpedAgo(10*time.Minute, "Lab 5")}
+	got, over := limit("Lab 5")
+	require.True(t, over)
+	require.Equal(t, HelpLimit{Rule: LimitCooldown, Times: 1, Until: now.Add(10 * time.Minute)}, got)
+
+	// Students who left before a TA got to them weren't helped.
+	leftEarly := helpedAgo(10*time.Minute, "Lab 5")
+	leftEarly.LeftEarly = true
+	queue.Entries = []QueueEntry{helpedAgo(5*time.Hour, "Lab 5"), leftEarly}
+	_, over = limit("Lab 5")
+	require.False(t, over)
+
+	// Students can come back once the oldest time that counts is a day old.
+	queue.Entries = []QueueEntry{helpedAgo(5*time.Hour, "Lab 5"), helpedAgo(3*time.Hour, "Lab 5")}
+	got, over = limit("Lab 5")
+	require.True(t, over)
+	require.Equal(t, HelpLimit{Rule: LimitDaily, Times: 2, Until: now.Add(19 * time.Hour)}, got)
+
+	queue.Entries = []QueueEntry{helpedAgo(3*time.Hour, "Exam review")}
+	_, over = limit("Lab 5")
+	require.False(t, over)
+	got, over = limit("Exam review")
+	require.True(t, over)
+	require.Equal(t, HelpLimit{Rule: LimitCategory, Times: 1, Category: "Exam review", Until: now.Add(21 * time.Hour)}, got)
+
+	queue.Entries = []QueueEntry{helpedAgo(6*24*time.Hour, ""), helpedAgo(3*24*time.Hour, ""), helpedAgo(2*24*time.Hour, "")}
+	got, over = limit("")
+	require.True(t, over)
+	require.Equal(t, HelpLimit{Rule: LimitWeekly, Times: 3, Until: now.Add(24 * time.Hour)}, got)
+
+	// The limit that lasts the longest wins.
+	queue.Entries = append(queue.Entries, helpedAgo(time.Hour, ""), helpedAgo(5*time.Minute, ""))
+	got, _ = limit("")
+	require.Equal(t, LimitWeekly, got.Rule)
+	require.Equal(t, uint(5), got.Times)
+	require.Equal(t, now.Add(5*24*time.Hour), got.Until)
+	got, _ = helpLimitLocked(QueueEntry{CSid: "r3a2b"}, now)
+	require.Zero(t, got)
+
+	cfg.AllowOverLimitWhenEmpty = true
+	SetConfig(cfg)
+	_, over = limit("")
+	require.False(t, over)
+	queue.Entries = append(queue.Entries, QueueEntry{CSid: "r3a2b", JoinedAt: now})
+	_, over = limit("")
+	require.True(t, over)
+
+	cfg.LimitExemptCSids = []string{"r3a1b"}
+	SetConfig(cfg)
+	_, over = limit("")
+	require.False(t, over)
+}
+
+func TestJoinQueueOverLimit(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.HelpCooldownMinutes = 20
+	SetConfig(cfg)
+	queue.Entries = []QueueEntry{}
+
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a1b", TaskInfo: "Lost.", Locale: DefaultLocale})
+	_, found := ServeStudent("r3a1b", "ta1")
+	require.True(t, found)
+	_, waitTime, limit := JoinQueue(QueueEntry{Name: "Student", CSid: "r3a1b", TaskInfo: "Lost again.", Locale: DefaultLocale})
+	require.Equal(t, -1, waitTime)
+	require.Equal(t, LimitCooldown, limit.Rule)
+	require.WithinDuration(t, time.Now().Add(20*time.Minute), limit.Until, time.Second)
+	require.False(t, HasJoinedQueue("r3a1b"))
+}
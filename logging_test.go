@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := NewLogHandler(Config{LogFormat: "json", LogLevel: "info"}, &buf)
+	require.NoError(t, err)
+	slog.New(handler).Info("Student joined the queue.", append(ticketAttrs(QueueEntry{ID: 7}),
+		"name", "Joe Student", "task", "Totally lost.")...)
+	line := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "[redacted]", line["name"])
+	require.Equal(t, "[redacted]", line["task"])
+	require.Equal(t, "default", line["queue"])
+	require.Equal(t, float64(7), line["ticket"])
+
+	buf.Reset()
+	handler, err = NewLogHandler(Config{LogFormat: "logfmt", LogLevel: "warn", LogStudentDetails: true}, &buf)
+	require.NoError(t, err)
+	slog.New(handler).Info("Dropped, below the level.")
+	slog.New(handler).Warn("Kept.", "name", "Joe Student")
+	require.Contains(t, buf.String(), `name="Joe Student"`)
+	require.NotContains(t, buf.String(), "Dropped")
+
+	_, err = NewLogHandler(Config{LogFormat: "xml", LogLevel: "info"}, &buf)
+	require.Error(t, err)
+	_, err = NewLogHandler(Config{LogFormat: "json", LogLevel: "loud"}, &buf)
+	require.Error(t, err)
+}
+
+func TestRequestIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestLogging())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(requestIDKey))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "upstream-id.1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, "upstream-id.1", w.Body.String())
+	require.Equal(t, "upstream-id.1", w.Header().Get("X-Request-ID"))
+
+	// Unsafe IDs are replaced.
+	req.Header.Set("X-Request-ID", "bad id\n")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Len(t, w.Body.String(), 16)
+	require.Equal(t, w.Body.String(), w.Header().Get("X-Request-ID"))
+}
@@ -1,49 +1,211 @@
 package main
 
 import (
-	"github.com/dustin/go-humanize"
+	"flag"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"html/template"
-	"log"
+	"math"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var config Config
+// VAPID keys used for Web Push. nil if push notifications are turned off.
+var vapidKeys *VAPIDKeys
 
 func main() {
 
-	config = ReadConfig()
+	// Unlike the other subcommands, version works without a configuration.
+	if len(os.Args) == 2 && os.Args[1] == "version" {
+		fmt.Print(BuildInfo())
+		return
+	}
+	cfg, args, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fatal("Invalid configuration.", "error", err)
+	}
+	SetConfig(cfg)
+	configArgs = os.Args[1 : len(os.Args)-len(args)]
+	SetUpLogging(cfg)
+	keys, err := LoadDataKeys(cfg)
+	if err != nil {
+		fatal("Couldn't load the encryption key.", "error", err)
+	}
+	dataKeys = keys
+	if status, ok := RunCommand(args); ok {
+		os.Exit(status)
+	}
+	accounts, err := ReadTADatabase(cfg.AuthDBFile)
+	if err != nil {
+		fatal("Create the TA database before running this application.", "path", cfg.AuthDBFile, "error", err)
+	}
+	SetTAAccounts(accounts)
 	LoadDataFromDisk()
+	if err := LoadThemeOverrides(); err != nil {
+		fatal("Couldn't read theme.json.", "error", err)
+	}
+	RegisterNotifier(NewMetricsNotifier())
+	if cfg.SMTPHost != "" {
+		RegisterNotifier(NewEmailNotifier(cfg))
+	}
+	// The retention policy can be turned on by reloading the configuration.
+	go RunRetentionPolicy()
+	go RunAppointments()
+	go ReloadOnSIGHUP()
+	if len(cfg.Webhooks) > 0 {
+		webhooks, err := NewWebhookNotifier(cfg)
+		if err != nil {
+			fatal("Couldn't set up webhooks.", "error", err)
+		}
+		RegisterNotifier(webhooks)
+		go webhooks.WatchWaitTimes()
+	}
+	if cfg.VAPIDSubject != "" {
+		keys, err := LoadOrGenerateVAPIDKeys(cfg.DataPath("vapid.json"))
+		if err != nil {
+			fatal("Couldn't load VAPID keys from vapid.json.", "error", err)
+		}
+		vapidKeys = keys
+		RegisterNotifier(NewPushNotifier(cfg, keys))
+	}
 
 	router := gin.New()
-	router.Use(gin.Logger())
-	router.Delims("{{", "}}")
-	router.SetFuncMap(template.FuncMap{
-		"NumTimesHelped": NumTimesHelped,
-		"RelativeTime":   humanize.Time,
-	})
-	router.LoadHTMLGlob("templates/*.tmpl.html")
-	router.Static("/static", "static")
+	router.Use(RequestLogging())
+	router.Use(MetricsMiddleware(router))
+	router.Use(Localise())
+	staticFS := AssetFS("static", cfg.StaticDir)
+	hashes, err := StaticHashes(staticFS)
+	if err != nil {
+		fatal("Couldn't read the static files.", "error", err)
+	}
+	templates, err := LoadTemplates(AssetFS("templates", cfg.TemplatesDir), templateFuncs(hashes))
+	if err != nil {
+		fatal("Couldn't parse the templates.", "error", err)
+	}
+	router.SetHTMLTemplate(templates)
+	loaded, err := LoadCatalogues(AssetFS("locales", cfg.LocalesDir))
+	if err != nil {
+		fatal("Couldn't read the translations.", "error", err)
+	}
+	catalogues = loaded
+	router.Group("/", StaticCacheHeaders(hashes)).StaticFS("/static", http.FS(staticFS))
 	router.GET("/", handleIndex)
 	router.GET("/status", handleStatus)
-	router.POST("/status_for_id", handleStatusForID)
-	router.GET("/leaveearly", handleLeave)
-	router.POST("/isqueueopen", handleIsQueueOpen)
-	authorized := router.Group("/", gin.BasicAuth(LoadPasswordsFromDisk()))
+	router.POST("/status_for_id", RateLimited("/status_for_id", studentCSid), handleStatusForID)
+	router.GET("/leaveearly", RateLimited("/leaveearly", studentCSid), handleLeave)
+	router.POST("/snooze", RateLimited("/snooze", studentCSid), handleSnooze)
+	router.POST("/isqueueopen", RateLimited("/isqueueopen", nil), handleIsQueueOpen)
+	router.GET("/pushkey", handlePushKey)
+	router.POST("/pushsubscription", RateLimited("/pushsubscription", studentCSid), handlePushSubscription)
+	router.GET("/metrics", handleMetrics)
+	router.GET("/language", handleLanguage(router))
+	authorized := router.Group("/", RequireTA)
 	authorized.GET("/ta", handleTAStatus)
 	authorized.POST("/served", handleServed)
-	authorized.GET("/jsondump", handleDump)
+	authorized.POST("/ta/next", handleTakeNext)
+	authorized.GET("/ta/ticket", handleTicket)
+	authorized.POST("/ta/ticket/remove", handleRemoveTicket)
+	authorized.POST("/ta/ticket/move", handleMoveTicket)
+	authorized.POST("/ta/ticket/edit", handleEditTicket)
+	authorized.POST("/ta/ticket/merge", handleMergeTicket)
+	authorized.POST("/ta/ticket/noshow", handleNoShow)
+	authorized.GET("/ta/group", handleGroup)
+	authorized.POST("/ta/group", handleServeGroup)
+	authorized.POST("/ta/session/end", handleEndSession)
+	authorized.GET("/ta/whereabouts", handleWhereabouts)
+	authorized.POST("/ta/whereabouts", handleSetWhereabouts)
+	authorized.GET("/ta/categories", handleCategories)
+	authorized.GET("/ta/appointments", handleAvailability)
+	authorized.POST("/ta/appointments", handlePublishAvailability)
+	authorized.POST("/ta/appointments/remove", handleRemoveAvailability)
+	authorized.POST("/ta/categories", handleSubscribe)
+	authorized.GET("/webhookfailures", handleWebhookFailures)
+	authorized.GET("/admin/blocked", handleBlocked)
+	authorized.POST("/admin/blocked/unblock", handleUnblock)
 	authorized.POST("/openqueue", handleOpenQueue)
 	authorized.POST("/closequeue", handleCloseQueue)
-	router.POST("/join", handleJoinReq)
-	err := router.Run(":" + config.ListenAt)
+	instructors := authorized.Group("/", requireInstructor)
+	instructors.GET("/jsondump", handleDump)
+	instructors.GET("/admin/stats", handleStats)
+	instructors.GET("/admin/stats.json", handleStatsJSON)
+	instructors.GET("/export", handleExport)
+	instructors.GET("/admin/privacy", handlePrivacy)
+	instructors.GET("/admin/privacy/records", handleStudentRecords)
+	instructors.POST("/admin/privacy/erase", handleEraseStudent)
+	instructors.POST("/admin/reload", handleReload)
+	instructors.GET("/admin/theme", handleTheme)
+	instructors.POST("/admin/theme", handleSaveTheme)
+	instructors.POST("/admin/categories", handleSaveCategories)
+	instructors.GET("/admin/ordering", handleOrdering)
+	instructors.POST("/admin/ordering", handleSaveOrdering)
+	router.POST("/join", RateLimited("/join", nil), handleJoinReq)
+	router.GET("/appointments", RateLimited("/appointments", studentCSid), handleAppointments)
+	router.POST("/appointments/book", RateLimited("/appointments/book", studentCSid), handleBook)
+	router.POST("/appointments/cancel", RateLimited("/appointments/cancel", studentCSid), handleCancelBooking)
+	router.GET("/appointments/ics", RateLimited("/appointments/ics", studentCSid), handleBookingICS)
+	router.GET("/healthz", handleHealth)
+	router.GET("/readyz", handleReady)
+	err = ServeUntilSignalled(":"+cfg.ListenAt, router)
 	if err != nil {
-		log.Fatalln("Listening on port failed with error:", err)
+		fatal("Listening on port failed.", "error", err)
+	}
+}
+
+// templateFuncs returns the functions available in templates. hashes are
+// those of the static files, see AssetURL.
+func templateFuncs(hashes map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"Asset":          AssetURL(hashes),
+		"NumTimesHelped": NumTimesHelped,
+		"Now":            time.Now,
+		"RelativeTime":   RelativeTime,
+		"Clock":          func(t time.Time) string { return t.Format(appointmentTimeLayout) },
+		"TimeUntil":      TimeUntil,
+		"T":              Translate,
+		"THTML":          TranslateHTML,
+		"Locales":        Locales,
+		"LanguageName":   LanguageName,
+		"Weekday":        func(day int) string { return time.Weekday(day).String() },
+		"Shade": func(count int, max int) float64 {
+			if max == 0 {
+				return 0
+			}
+			return float64(count) / float64(max)
+		},
+		"Percent": func(fraction float64) string { return fmt.Sprintf("%.1f%%", fraction*100) },
+		"Hours":   func(minutes float64) string { return fmt.Sprintf("%.1f", minutes/60) },
+		"Join":    strings.Join,
 	}
 }
 
 func handleIndex(c *gin.Context) {
-	c.HTML(http.StatusOK, "index.tmpl.html", HomePageValues{TotalNumStudentsHelped(), ""})
+	c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, ""))
+}
+
+// homePageValues returns the values of the homepage, showing errMsg if it
+// isn't empty.
+func homePageValues(c *gin.Context, errMsg string) HomePageValues {
+	config := CurrentConfig()
+	return HomePageValues{
+		CountHelped:    TotalNumStudentsHelped(),
+		Error:          errMsg,
+		Categories:     Categories(),
+		LabSections:    config.LabSections,
+		Locations:      config.Locations,
+		MeetingDomains: config.MeetingDomains,
+		Appointments:   len(FreeSlots(time.Now())) > 0,
+		Theme:          CurrentTheme(DefaultQueueID),
+		Locale:         Locale(c),
+	}
 }
 
 func handleJoinReq(c *gin.Context) {
@@ -51,35 +213,326 @@ func handleJoinReq(c *gin.Context) {
 	CSid := c.PostForm("csid")
 	taskInfo := c.PostForm("task")
 	if !IsValidCSid(CSid) || name == "" {
-		hpv := HomePageValues{Error: "Invalid name or CS ID entered."}
-		c.HTML(http.StatusOK, "index.tmpl.html", hpv)
+		c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, Translate(Locale(c), "Invalid name or CS ID entered.")))
+		return
+	}
+	category := c.PostForm("category")
+	if (category != "" || len(Categories()) > 0) && !IsValidCategory(category) {
+		c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, Translate(Locale(c), "Please pick what your question is about.")))
 		return
 	}
+	section := c.PostForm("section")
+	if (section != "" || len(CurrentConfig().LabSections) > 0) && !IsValidLabSection(section) {
+		c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, Translate(Locale(c), "Please pick your lab section.")))
+		return
+	}
+	where, errMsg := parseWhereabouts(c)
+	config := CurrentConfig()
+	if errMsg == "" && where.IsZero() && (len(config.Locations) > 0 || len(config.MeetingDomains) > 0) {
+		errMsg = Translate(Locale(c), "Please tell us where you are, or share a link to your meeting.")
+	}
+	if errMsg != "" {
+		c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, errMsg))
+		return
+	}
+	email := ""
+	if c.PostForm("notify") != "" {
+		address, err := mail.ParseAddress(c.PostForm("email"))
+		if err != nil {
+			c.HTML(http.StatusOK, "index.tmpl.html", homePageValues(c, Translate(Locale(c), "Invalid email address entered.")))
+			return
+		}
+		email = address.Address
+	}
 	if HasJoinedQueue(CSid) {
-		hpv := HomePageValues{Error: "You have already joined the queue! Click above to see your status."}
-		c.HTML(http.StatusOK, "index.tmpl.html", hpv)
+		c.HTML(http.StatusOK, "index.tmpl.html",
+			homePageValues(c, Translate(Locale(c), "You have already joined the queue! Click above to see your status.")))
 		return
 	}
 	c.SetCookie("queue-csid", CSid, 0, "", "", true, false)
 	c.SetCookie("queue-secret", GenerateSecretForCSid(CSid), 0, "", "", true, false)
-	aheadOfMe, waitTime := JoinQueue(name, CSid, taskInfo)
+	aheadOfMe, waitTime, limit := JoinQueue(QueueEntry{
+		CSid:       CSid,
+		Name:       name,
+		TaskInfo:   taskInfo,
+		Category:   category,
+		LabSection: section,
+		Where:      where,
+		Email:      email,
+		Locale:     Locale(c),
+	})
 	if waitTime != -1 {
-		c.HTML(http.StatusOK, "status.tmpl.html", nil)
+		ticket, _ := WaitingTicket(CSid)
+		RequestLogger(c).Info("Student joined the queue.", append(ticketAttrs(ticket),
+			"name", name, "task", taskInfo, "category", category, "section", section, "location", where.Location,
+			"ahead", aheadOfMe)...)
+		c.HTML(http.StatusOK, "status.tmpl.html", studentStatusValues(c))
 	} else {
+		RequestLogger(c).Info("Student was turned away for a help limit.",
+			"queue", DefaultQueueID, "name", name, "rule", limit.Rule, "times_helped", limit.Times,
+			"category", limit.Category, "until", limit.Until)
 		rpv := RejectedPageValues{
-			NumTimesJoined: aheadOfMe,
-			Name:           name,
+			Limit:           limit,
+			CooldownMinutes: config.HelpCooldownMinutes,
+			Name:            name,
+			Theme:           CurrentTheme(DefaultQueueID),
+			Locale:          Locale(c),
 		}
 		c.HTML(http.StatusOK, "rejected.tmpl.html", rpv)
 	}
 }
 
+func handleAppointments(c *gin.Context) {
+	showAppointments(c, studentCSid(c), "", "")
+}
+
+func handleBook(c *gin.Context) {
+	name := c.PostForm("name")
+	CSid := c.PostForm("csid")
+	if proven := studentCSid(c); proven != "" {
+		// The cookie proves who the student is, whatever they typed.
+		CSid = proven
+	} else if HasJoinedQueue(CSid) || len(StudentBookings(CSid, time.Now())) > 0 {
+		// As when joining the queue, a CS ID that is already in use can only
+		// be used from the browser that has its cookie.
+		showAppointments(c, "", Translate(Locale(c), "This CS ID already has an appointment or a place in the queue. Please book from the browser you used then."), "")
+		return
+	}
+	if !IsValidCSid(CSid) || name == "" {
+		showAppointments(c, studentCSid(c), Translate(Locale(c), "Invalid name or CS ID entered."), "")
+		return
+	}
+	var blockID uint
+	var start int64
+	if _, err := fmt.Sscanf(c.PostForm("slot"), "%d-%d", &blockID, &start); err != nil {
+		showAppointments(c, studentCSid(c), Translate(Locale(c), "Please pick a time."), "")
+		return
+	}
+	email := ""
+	if c.PostForm("email") != "" {
+		address, err := mail.ParseAddress(c.PostForm("email"))
+		if err != nil {
+			showAppointments(c, studentCSid(c), Translate(Locale(c), "Invalid email address entered."), "")
+			return
+		}
+		email = address.Address
+	}
+	booking, err := BookSlot(Booking{
+		BlockID:  blockID,
+		Start:    time.Unix(start, 0),
+		CSid:     CSid,
+		Name:     name,
+		TaskInfo: c.PostForm("task"),
+		Email:    email,
+		Locale:   Locale(c),
+	}, time.Now())
+	switch err {
+	case nil:
+	case ErrSlotTaken:
+		showAppointments(c, studentCSid(c), Translate(Locale(c), "Somebody else just booked that time. Please pick another one."), "")
+		return
+	case ErrBookingLimit:
+		showAppointments(c, studentCSid(c), Translate(Locale(c), "You can book %d appointments in 7 days. Please join the queue instead.",
+			CurrentConfig().MaxBookingsPerWeek), "")
+		return
+	case ErrDoubleBooked:
+		showAppointments(c, studentCSid(c), Translate(Locale(c), "You already have an appointment at that time."), "")
+		return
+	default:
+		showAppointments(c, studentCSid(c), err.Error(), "")
+		return
+	}
+	RequestLogger(c).Info("Student booked an appointment.", "queue", DefaultQueueID, "booking", booking.ID,
+		"ta", booking.TA, "start", booking.Start, "name", name, "task", booking.TaskInfo)
+	c.SetCookie("queue-csid", CSid, 0, "", "", true, false)
+	c.SetCookie("queue-secret", GenerateSecretForCSid(CSid), 0, "", "", true, false)
+	showAppointments(c, CSid, "", Translate(Locale(c), "Your appointment is booked for %s. You will be at the front of the queue when it starts.",
+		booking.Start.Format(appointmentTimeLayout)))
+}
+
+func handleCancelBooking(c *gin.Context) {
+	CSid := getCSIDFromCookie(c)
+	if CSid == "" {
+		return
+	}
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	if booking, found := CancelBooking(CSid, ID); found {
+		RequestLogger(c).Info("Student cancelled an appointment.", "queue", DefaultQueueID, "booking", booking.ID,
+			"ta", booking.TA, "start", booking.Start)
+	}
+	c.Redirect(http.StatusSeeOther, "/appointments")
+}
+
+func handleBookingICS(c *gin.Context) {
+	CSid := getCSIDFromCookie(c)
+	if CSid == "" {
+		return
+	}
+	ID, ok := ticketID(c, c.Query("id"))
+	if !ok {
+		return
+	}
+	booking, found := StudentBooking(CSid, ID)
+	if !found {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=appointment.ics")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(BookingICS(booking, CurrentTheme(DefaultQueueID).CourseName)))
+}
+
+// showAppointments renders the page where students book appointments, with
+// the upcoming appointments of the student with given CSid, if any.
+func showAppointments(c *gin.Context, CSid string, errMsg string, message string) {
+	config := CurrentConfig()
+	apv := AppointmentsPageValues{
+		Slots:              FreeSlots(time.Now()),
+		MaxBookingsPerWeek: config.MaxBookingsPerWeek,
+		Emails:             config.SMTPHost != "",
+		Error:              errMsg,
+		Message:            message,
+		Theme:              CurrentTheme(DefaultQueueID),
+		Locale:             Locale(c),
+	}
+	if CSid != "" {
+		apv.Bookings = StudentBookings(CSid, time.Now())
+	}
+	c.HTML(http.StatusOK, "appointments.tmpl.html", apv)
+}
+
+func handleAvailability(c *gin.Context) {
+	showAvailability(c, "", "")
+}
+
+func handlePublishAvailability(c *gin.Context) {
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	date := c.PostForm("date")
+	start, err := time.ParseInLocation(appointmentTimeLayout, date+" "+c.PostForm("start"), time.Local)
+	end, err1 := time.ParseInLocation(appointmentTimeLayout, date+" "+c.PostForm("end"), time.Local)
+	if err != nil || err1 != nil {
+		showAvailability(c, Translate(Locale(c), "Please enter a date, and start and end times."), "")
+		return
+	}
+	block, err := PublishAvailability(AvailabilityBlock{TA: TA, Start: start, End: end, Category: c.PostForm("category")}, time.Now())
+	if err != nil {
+		showAvailability(c, err.Error(), "")
+		return
+	}
+	RequestLogger(c).Info("TA published availability.", "queue", DefaultQueueID, "block", block.ID,
+		"start", block.Start, "end", block.End, "category", block.Category)
+	showAvailability(c, "", Translate(Locale(c), "Students can now book you from %s to %s.",
+		block.Start.Format(appointmentTimeLayout), block.End.Format("15:04")))
+}
+
+func handleRemoveAvailability(c *gin.Context) {
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	block, cancelled, found := RemoveAvailability(TA, ID)
+	if !found {
+		showAvailability(c, Translate(Locale(c), "This block no longer exists."), "")
+		return
+	}
+	RequestLogger(c).Info("TA removed availability.", "queue", DefaultQueueID, "block", block.ID,
+		"cancelled", len(cancelled))
+	showAvailability(c, "", Translate(Locale(c), "Removed, and cancelled %d appointments.", len(cancelled)))
+}
+
+// showAvailability renders the page where TAs publish when students can
+// book them, with the appointments booked so far.
+func showAvailability(c *gin.Context, errMsg string, message string) {
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	c.HTML(http.StatusOK, "availability.tmpl.html", AvailabilityPageValues{
+		Blocks:             TAAvailability(TA, time.Now()),
+		Bookings:           TABookings(TA, time.Now()),
+		Categories:         Categories(),
+		AppointmentMinutes: CurrentConfig().AppointmentMinutes,
+		Error:              errMsg,
+		Message:            message,
+		Theme:              CurrentTheme(DefaultQueueID),
+		Locale:             Locale(c),
+	})
+}
+
+// parseWhereabouts returns where the student or TA filling in the form said
+// they are, or an error message for them.
+func parseWhereabouts(c *gin.Context) (Whereabouts, string) {
+	where := Whereabouts{
+		Location:   c.PostForm("location"),
+		MeetingURL: strings.TrimSpace(c.PostForm("meeting_url")),
+	}
+	if where.Location != "" && !IsValidLocation(where.Location) {
+		return where, Translate(Locale(c), "Please pick where you are from the list.")
+	}
+	if where.MeetingURL != "" && !IsValidMeetingURL(where.MeetingURL) {
+		return where, Translate(Locale(c), "Meeting links must start with https:// and be on %s.",
+			strings.Join(CurrentConfig().MeetingDomains, ", "))
+	}
+	return where, ""
+}
+
 func handleStatus(c *gin.Context) {
-	c.HTML(http.StatusOK, "status.tmpl.html", nil)
+	c.HTML(http.StatusOK, "status.tmpl.html", studentStatusValues(c))
+}
+
+// studentStatusValues returns the values of the student's status page, which
+// fetches the student's position itself.
+func studentStatusValues(c *gin.Context) StatusPageValues {
+	config := CurrentConfig()
+	return StatusPageValues{
+		DeferPositions: config.DeferPositions,
+		DeferMinutes:   config.DeferMinutes,
+		Theme:          CurrentTheme(DefaultQueueID),
+		Locale:         Locale(c),
+	}
+}
+
+func handleSnooze(c *gin.Context) {
+	CSid := getCSIDFromCookie(c)
+	if CSid == "" {
+		return
+	}
+	if ticket, found := Snooze(CSid); found {
+		RequestLogger(c).Info("Student let others go ahead.", ticketAttrs(ticket)...)
+	}
+	c.Redirect(http.StatusSeeOther, "/status")
 }
 
 func handleTAStatus(c *gin.Context) {
-	spv := StatusPageValues{UnservedEntries()}
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	spv := StatusPageValues{Sessions: ActiveSessions(), Whereabouts: TAWhereabouts(TA),
+		Categories: Categories(), NobodyNext: c.Query("nobody") != "",
+		Theme: CurrentTheme(DefaultQueueID), Locale: Locale(c)}
+	if helping, ok := CurrentlyHelping(TA, time.Now()); ok {
+		spv.Helping = &helping
+	}
+	// The filter is remembered in a cookie, so that it sticks after acting
+	// on a ticket.
+	filter := c.Request.URL.Query()
+	if _, ok := filter["category"]; ok {
+		c.SetCookie("ta-filter", filter.Encode(), 0, "/ta", "", true, true)
+	} else if cookie, err := c.Cookie("ta-filter"); err == nil {
+		filter, _ = url.ParseQuery(cookie)
+	}
+	var shown []string
+	if filter.Get("mine") != "" {
+		spv.Mine = true
+		shown = TACategories(TA)
+	} else if spv.Category = filter.Get("category"); spv.Category != "" {
+		shown = []string{spv.Category}
+	}
+	for _, entry := range UnservedEntries() {
+		if InCategories(entry, shown) {
+			spv.Entries = append(spv.Entries, entry)
+		} else {
+			spv.Hidden++
+		}
+	}
 	c.HTML(http.StatusOK, "tastatus.tmpl.html", spv)
 }
 
@@ -89,37 +542,566 @@ func handleServed(c *gin.Context) {
 		handleTAStatus(c)
 		return
 	}
-	ServeStudent(csid)
+	if ticket, found := ServeStudent(csid, c.MustGet(gin.AuthUserKey).(string)); found {
+		RequestLogger(c).Info("TA picked a student.", ticketAttrs(ticket)...)
+	}
 	c.Redirect(http.StatusMovedPermanently, "/ta")
 }
 
+func handleTakeNext(c *gin.Context) {
+	ticket, found := TakeNext(c.MustGet(gin.AuthUserKey).(string))
+	if !found {
+		c.Redirect(http.StatusSeeOther, "/ta?nobody=1")
+		return
+	}
+	RequestLogger(c).Info("TA took the next student.", ticketAttrs(ticket)...)
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleTicket(c *gin.Context) {
+	if ID, ok := ticketID(c, c.Query("id")); ok {
+		showTicket(c, ID, "")
+	}
+}
+
+func handleRemoveTicket(c *gin.Context) {
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	if reason == "" {
+		showTicket(c, ID, Translate(Locale(c), "Please say why the ticket is being removed."))
+		return
+	}
+	if ticket, found := RemoveTicket(ID, c.MustGet(gin.AuthUserKey).(string), reason); found {
+		RequestLogger(c).Info("TA removed a ticket.", append(ticketAttrs(ticket), "reason", reason)...)
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleMoveTicket(c *gin.Context) {
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	position, err := strconv.ParseUint(c.PostForm("position"), 10, 0)
+	if err != nil || position == 0 {
+		showTicket(c, ID, Translate(Locale(c), "Positions start at 1, the front of the queue."))
+		return
+	}
+	if ticket, found := MoveTicket(ID, uint(position)-1); found {
+		RequestLogger(c).Info("TA moved a ticket.", append(ticketAttrs(ticket), "position", position)...)
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleEditTicket(c *gin.Context) {
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(c.PostForm("name"))
+	taskInfo := strings.TrimSpace(c.PostForm("task"))
+	if name == "" {
+		showTicket(c, ID, Translate(Locale(c), "Please enter a name."))
+		return
+	}
+	if ticket, found := EditTicket(ID, name, taskInfo); found {
+		RequestLogger(c).Info("TA edited a ticket.", append(ticketAttrs(ticket), "name", name, "task", taskInfo)...)
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleNoShow(c *gin.Context) {
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	if ticket, found := NoShow(ID, c.MustGet(gin.AuthUserKey).(string)); found {
+		if ticket.DroppedAsNoShow {
+			RequestLogger(c).Info("Dropped a ticket after too many no-shows.", append(ticketAttrs(ticket), "no_shows", ticket.NoShows)...)
+		} else {
+			RequestLogger(c).Info("TA couldn't find a student, deferred their ticket.", append(ticketAttrs(ticket), "no_shows", ticket.NoShows)...)
+		}
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleMergeTicket(c *gin.Context) {
+	ID, ok := ticketID(c, c.PostForm("id"))
+	if !ok {
+		return
+	}
+	into, ok := ticketID(c, c.PostForm("into"))
+	if !ok {
+		return
+	}
+	if ticket, found := MergeTickets(ID, into, c.MustGet(gin.AuthUserKey).(string)); found {
+		RequestLogger(c).Info("TA merged a duplicate ticket.", append(ticketAttrs(ticket), "duplicate", ID)...)
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleGroup(c *gin.Context) {
+	where := TAWhereabouts(c.MustGet(gin.AuthUserKey).(string))
+	location := where.Location
+	if location == "" {
+		location = where.MeetingURL
+	}
+	c.HTML(http.StatusOK, "group.tmpl.html", GroupPageValues{
+		Entries:  UnservedEntries(),
+		Location: location,
+		Theme:    CurrentTheme(DefaultQueueID),
+		Locale:   Locale(c),
+	})
+}
+
+func handleServeGroup(c *gin.Context) {
+	gpv := GroupPageValues{
+		Selected: map[uint]bool{},
+		Location: strings.TrimSpace(c.PostForm("location")),
+		Theme:    CurrentTheme(DefaultQueueID),
+		Locale:   Locale(c),
+	}
+	var IDs []uint
+	for _, value := range c.PostFormArray("id") {
+		ID, ok := ticketID(c, value)
+		if !ok {
+			return
+		}
+		IDs = append(IDs, ID)
+		gpv.Selected[ID] = true
+	}
+	if len(IDs) < 2 {
+		gpv.Error = Translate(Locale(c), "Please pick at least two students.")
+	} else if session, ok := ServeGroup(IDs, c.MustGet(gin.AuthUserKey).(string), gpv.Location); ok {
+		RequestLogger(c).Info("TA started a group session.", "queue", DefaultQueueID, "session", session.ID, "tickets", session.Tickets)
+		c.Redirect(http.StatusSeeOther, "/ta")
+		return
+	} else {
+		gpv.Error = Translate(Locale(c), "Some of these students aren't waiting anymore, please pick again.")
+	}
+	gpv.Entries = UnservedEntries()
+	c.HTML(http.StatusOK, "group.tmpl.html", gpv)
+}
+
+func handleEndSession(c *gin.Context) {
+	ID, err := strconv.ParseUint(c.PostForm("id"), 10, 0)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if session, found := EndSession(uint(ID)); found {
+		RequestLogger(c).Info("TA ended a group session.", "queue", DefaultQueueID, "session", session.ID,
+			"minutes", session.EndedAt.Sub(session.StartedAt).Minutes())
+	}
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+func handleWhereabouts(c *gin.Context) {
+	showWhereabouts(c, TAWhereabouts(c.MustGet(gin.AuthUserKey).(string)), "")
+}
+
+func handleSetWhereabouts(c *gin.Context) {
+	where, errMsg := parseWhereabouts(c)
+	if errMsg != "" {
+		showWhereabouts(c, where, errMsg)
+		return
+	}
+	SetTAWhereabouts(c.MustGet(gin.AuthUserKey).(string), where)
+	RequestLogger(c).Info("TA changed where they are.", "location", where.Location, "remote", where.MeetingURL != "")
+	c.Redirect(http.StatusSeeOther, "/ta")
+}
+
+// showWhereabouts renders the page where TAs say where they are.
+func showWhereabouts(c *gin.Context, where Whereabouts, errMsg string) {
+	config := CurrentConfig()
+	c.HTML(http.StatusOK, "whereabouts.tmpl.html", WhereaboutsPageValues{
+		Whereabouts:    where,
+		Locations:      config.Locations,
+		MeetingDomains: config.MeetingDomains,
+		Error:          errMsg,
+		Theme:          CurrentTheme(DefaultQueueID),
+		Locale:         Locale(c),
+	})
+}
+
+func handleCategories(c *gin.Context) {
+	showCategories(c, "", "")
+}
+
+func handleSubscribe(c *gin.Context) {
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	SetTACategories(TA, c.PostFormArray("category"))
+	RequestLogger(c).Info("TA changed the categories they subscribed to.", "categories", TACategories(TA))
+	c.Redirect(http.StatusSeeOther, "/ta?category=&mine=1")
+}
+
+func handleSaveCategories(c *gin.Context) {
+	categories := ParseCategories(c.PostForm("categories"))
+	if err := SetCategories(categories); err != nil {
+		showCategories(c, Translate(Locale(c), "Couldn't save the categories: %s.", err), c.PostForm("categories"))
+		return
+	}
+	RequestLogger(c).Info("Changed the categories.", "queue", DefaultQueueID, "categories", categories)
+	showCategories(c, "", "")
+}
+
+// showCategories renders the page where TAs subscribe to categories, and
+// instructors edit them. text is what the instructor entered, if it
+// couldn't be saved.
+func showCategories(c *gin.Context, errMsg string, text string) {
+	TA := c.MustGet(gin.AuthUserKey).(string)
+	cpv := CategoriesPageValues{
+		Categories: Categories(),
+		Subscribed: map[string]bool{},
+		Instructor: IsInstructor(TA),
+		Text:       text,
+		Error:      errMsg,
+		Theme:      CurrentTheme(DefaultQueueID),
+		Locale:     Locale(c),
+	}
+	for _, category := range TACategories(TA) {
+		cpv.Subscribed[category] = true
+	}
+	if errMsg == "" {
+		cpv.Text = strings.Join(cpv.Categories, "\n")
+	}
+	c.HTML(http.StatusOK, "categories.tmpl.html", cpv)
+}
+
+// showTicket renders the page of the waiting ticket with given ID, or takes
+// the TA back to the panel if it isn't waiting anymore.
+func showTicket(c *gin.Context, ID uint, errorMsg string) {
+	tpv := TicketPageValues{Error: errorMsg, Theme: CurrentTheme(DefaultQueueID), Locale: Locale(c)}
+	found := false
+	for i, entry := range UnservedEntries() {
+		if entry.ID == ID {
+			tpv.Entry, tpv.Position, found = entry, uint(i)+1, true
+		} else {
+			tpv.Others = append(tpv.Others, entry)
+		}
+	}
+	if !found {
+		c.Redirect(http.StatusSeeOther, "/ta")
+		return
+	}
+	c.HTML(http.StatusOK, "ticket.tmpl.html", tpv)
+}
+
+// ticketID parses a ticket number, and answers with 400 if it isn't one.
+func ticketID(c *gin.Context, value string) (uint, bool) {
+	ID, err := strconv.ParseUint(value, 10, 0)
+	if err != nil || ID == 0 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(ID), true
+}
+
 func handleLeave(c *gin.Context) {
-	CSid, err := c.Cookie("queue-csid")
-	secret, err := c.Cookie("queue-secret")
-	if err != nil || CSid == "" || !IsValidCSid(CSid) ||
-		!CheckSecretForCSid(secret, CSid) {
+	CSid := studentCSid(c)
+	if CSid == "" {
 		c.AbortWithStatus(http.StatusForbidden)
 		return
 	}
-	ServeStudent(CSid)
+	if ticket, found := LeaveQueue(CSid); found {
+		RequestLogger(c).Info("Student left the queue.", ticketAttrs(ticket)...)
+	}
 	c.Redirect(http.StatusMovedPermanently, "/status")
 }
 
+func handleBlocked(c *gin.Context) {
+	c.HTML(http.StatusOK, "blocked.tmpl.html", BlockedPageValues{
+		Clients: rateLimiter.Blocked(time.Now()),
+		Theme:   CurrentTheme(DefaultQueueID),
+		Locale:  Locale(c),
+	})
+}
+
+func handleUnblock(c *gin.Context) {
+	bpv := BlockedPageValues{Theme: CurrentTheme(DefaultQueueID), Locale: Locale(c)}
+	if client, found := rateLimiter.Unblock(c.PostForm("key")); found {
+		RequestLogger(c).Info("Unblocked a rate limited client.", "route", client.Route, "kind", client.Kind)
+		bpv.Message = Translate(Locale(c), "Unblocked %s.", client.Client)
+	}
+	bpv.Clients = rateLimiter.Blocked(time.Now())
+	c.HTML(http.StatusOK, "blocked.tmpl.html", bpv)
+}
+
 func handleDump(c *gin.Context) {
-	c.File("persistence.json")
+	c.Data(http.StatusOK, "application/json", DumpJSON())
+}
+
+func handleWebhookFailures(c *gin.Context) {
+	c.File(CurrentConfig().DataPath("webhook_deadletters.json"))
+}
+
+func handleStats(c *gin.Context) {
+	from, to, ok := statsRange(c)
+	if !ok {
+		return
+	}
+	stats := ComputeStats(AllEntries(), AllSessions(), from, to)
+	spv := StatsPageValues{
+		Stats:  stats,
+		From:   from.Format("2006-01-02"),
+		To:     to.AddDate(0, 0, -1).Format("2006-01-02"),
+		Theme:  CurrentTheme(DefaultQueueID),
+		Locale: Locale(c),
+	}
+	for _, hours := range stats.TicketsPerHourOfWeek {
+		for _, count := range hours {
+			if count > spv.MaxPerHour {
+				spv.MaxPerHour = count
+			}
+		}
+	}
+	c.HTML(http.StatusOK, "stats.tmpl.html", spv)
+}
+
+func handleStatsJSON(c *gin.Context) {
+	from, to, ok := statsRange(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, ComputeStats(AllEntries(), AllSessions(), from, to))
+}
+
+func handleExport(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	opts, err := exportOptions(format, c.Query("columns"), c.Query("from"), c.Query("to"),
+		c.Query("pseudonymise") != "")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	contentType := "text/csv; charset=utf-8"
+	if format == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=tickets."+format)
+	if err := WriteExport(c.Writer, AllEntries(), opts); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+	}
+}
+
+func handlePrivacy(c *gin.Context) {
+	config := CurrentConfig()
+	c.HTML(http.StatusOK, "privacy.tmpl.html", PrivacyPageValues{
+		RetentionDays:   config.RetentionDays,
+		RetentionAction: config.RetentionAction,
+		Theme:           CurrentTheme(DefaultQueueID),
+		Locale:          Locale(c),
+	})
+}
+
+func handleStudentRecords(c *gin.Context) {
+	CSid := c.Query("csid")
+	if CSid == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=records.json")
+	c.JSON(http.StatusOK, gin.H{"tickets": StudentRecords(CSid), "bookings": StudentBookingRecords(CSid)})
+}
+
+func handleEraseStudent(c *gin.Context) {
+	config := CurrentConfig()
+	ppv := PrivacyPageValues{RetentionDays: config.RetentionDays, RetentionAction: config.RetentionAction,
+		Theme: CurrentTheme(DefaultQueueID), Locale: Locale(c)}
+	CSid := c.PostForm("csid")
+	if CSid == "" || c.PostForm("confirm") != CSid {
+		ppv.Error = Translate(Locale(c), "Please type the CS ID again to confirm.")
+		c.HTML(http.StatusOK, "privacy.tmpl.html", ppv)
+		return
+	}
+	erased, erasedBookings := EraseStudent(CSid)
+	RequestLogger(c).Info("Erased tickets at a student's request.", "tickets", erased, "bookings", erasedBookings)
+	ppv.Message = Translate(Locale(c), "Erased %d tickets and %d appointments.", erased, erasedBookings)
+	c.HTML(http.StatusOK, "privacy.tmpl.html", ppv)
+}
+
+// statsRange reads the date range from the "from" and "to" query parameters
+// (YYYY-MM-DD, both inclusive), and returns it as [from, to).
+// Defaults to the last 30 days. Ranges can be at most a year long.
+func statsRange(c *gin.Context) (time.Time, time.Time, bool) {
+	today := Today()
+	from, to, err := ParseDateRange(c.Query("from"), c.Query("to"), today.AddDate(0, 0, -29), today)
+	if err != nil || to.After(from.AddDate(1, 0, 1)) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return from, to, false
+	}
+	return from, to, true
 }
 
 func handleStatusForID(c *gin.Context) {
 	CSid := getCSIDFromCookie(c)
 	isWaiting, position := QueuePositionForCSID(CSid)
-	c.JSON(http.StatusOK, map[string]interface{}{
-		"success":  isWaiting,
-		"csid":     CSid,
-		"position": position,
-		"waittime": uint(EstimatedWaitTime() / 60),
+	deferredMinutes := 0
+	if ticket, ok := WaitingTicket(CSid); ok && ticket.IsDeferred(time.Now()) {
+		deferredMinutes = int(math.Ceil(time.Until(ticket.DeferredUntil).Minutes()))
+	}
+	status := map[string]interface{}{
+		"success":          isWaiting,
+		"csid":             CSid,
+		"position":         position,
+		"waittime":         uint(EstimatedWaitTime() / 60),
+		"deferred_minutes": deferredMinutes,
+	}
+	if session, ok := StudentSession(CSid); ok && !isWaiting {
+		status["session"] = groupSessionText(Locale(c), session)
+	} else if claimed, ok := StudentClaim(CSid, time.Now()); ok && !isWaiting {
+		status["claimed"] = claimText(Locale(c), claimed)
+		status["meeting_url"] = claimMeetingURL(claimed)
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func handlePushKey(c *gin.Context) {
+	if vapidKeys == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"key": vapidKeys.PublicKey(),
+	})
+}
+
+func handlePushSubscription(c *gin.Context) {
+	if vapidKeys == nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	CSid := getCSIDFromCookie(c)
+	if CSid == "" {
+		return
+	}
+	sub := PushSubscription{}
+	if err := c.BindJSON(&sub); err != nil {
+		return
+	}
+	if err := sub.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": SetPushSubscription(CSid, &sub),
+	})
+}
+
+func handleHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func handleReady(c *gin.Context) {
+	readiness := CheckReadiness(time.Now())
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, readiness)
+}
+
+func handleTheme(c *gin.Context) {
+	c.HTML(http.StatusOK, "theme.tmpl.html", ThemePageValues{
+		Override: ThemeOverride(DefaultQueueID),
+		Theme:    CurrentTheme(DefaultQueueID),
+		Locale:   Locale(c),
+	})
+}
+
+func handleSaveTheme(c *gin.Context) {
+	override := Theme{
+		CourseName:       strings.TrimSpace(c.PostForm("CourseName")),
+		NavbarColour:     strings.TrimSpace(c.PostForm("NavbarColour")),
+		AccentColour:     strings.TrimSpace(c.PostForm("AccentColour")),
+		LogoURL:          strings.TrimSpace(c.PostForm("LogoURL")),
+		Announcement:     strings.TrimSpace(c.PostForm("Announcement")),
+		JoinHelpText:     strings.TrimSpace(c.PostForm("JoinHelpText")),
+		RejectionMessage: strings.TrimSpace(c.PostForm("RejectionMessage")),
+		ForumURL:         strings.TrimSpace(c.PostForm("ForumURL")),
+	}
+	tpv := ThemePageValues{Override: override, Locale: Locale(c)}
+	if err := SetThemeOverride(DefaultQueueID, override); err != nil {
+		tpv.Error = err.Error()
+	} else {
+		RequestLogger(c).Info("Changed the theme.", "queue", DefaultQueueID)
+		tpv.Message = Translate(Locale(c), "Saved.")
+	}
+	tpv.Theme = CurrentTheme(DefaultQueueID)
+	c.HTML(http.StatusOK, "theme.tmpl.html", tpv)
+}
+
+func handleOrdering(c *gin.Context) {
+	showOrdering(c, CurrentOrdering(), "", "")
+}
+
+func handleSaveOrdering(c *gin.Context) {
+	settings := OrderingSettings{Name: c.PostForm("policy"), PrioritySections: c.PostFormArray("section")}
+	if err := SetOrdering(settings); err != nil {
+		showOrdering(c, settings, err.Error(), "")
+		return
+	}
+	RequestLogger(c).Info("Changed the ordering policy.", "queue", DefaultQueueID, "policy", settings.Name,
+		"sections", settings.PrioritySections)
+	showOrdering(c, settings, "", Translate(Locale(c), "Saved."))
+}
+
+// showOrdering renders the page where instructors pick the ordering policy.
+func showOrdering(c *gin.Context, settings OrderingSettings, errMsg string, message string) {
+	opv := OrderingPageValues{
+		Settings:    settings,
+		LabSections: CurrentConfig().LabSections,
+		Priority:    map[string]bool{},
+		Error:       errMsg,
+		Message:     message,
+		Theme:       CurrentTheme(DefaultQueueID),
+		Locale:      Locale(c),
+	}
+	for _, section := range settings.PrioritySections {
+		opv.Priority[section] = true
+	}
+	c.HTML(http.StatusOK, "ordering.tmpl.html", opv)
+}
+
+func handleReload(c *gin.Context) {
+	changes, err := ReloadSettings()
+	logReload(RequestLogger(c), changes, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"changes": changes,
 	})
 }
 
+func handleMetrics(c *gin.Context) {
+	config := CurrentConfig()
+	if config.MetricsToken == "" && len(config.MetricsAllowedIPs) == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !CanReadMetrics(c.Request) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(c.Writer)
+}
+
 func handleIsQueueOpen(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"open": IsQueueOpen(),
@@ -128,6 +1110,7 @@ func handleIsQueueOpen(c *gin.Context) {
 
 func handleOpenQueue(c *gin.Context) {
 	OpenQueue()
+	RequestLogger(c).Info("Opened the queue.", "queue", DefaultQueueID)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 	})
@@ -135,17 +1118,64 @@ func handleOpenQueue(c *gin.Context) {
 
 func handleCloseQueue(c *gin.Context) {
 	CloseQueue()
+	RequestLogger(c).Info("Closed the queue.", "queue", DefaultQueueID)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 	})
 }
 
-func getCSIDFromCookie(c *gin.Context) string {
+// requireInstructor aborts the request unless the TA is an instructor.
+func requireInstructor(c *gin.Context) {
+	if !IsInstructor(c.MustGet(gin.AuthUserKey).(string)) {
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+// studentCSid returns the CSid of the student using this browser, if they
+// joined the queue or booked an appointment from it, or "". Checking the
+// secret is slow, so the result is kept for the rest of the request.
+func studentCSid(c *gin.Context) string {
+	if CSid, found := c.Get(studentCSidKey); found {
+		return CSid.(string)
+	}
 	CSid, err := c.Cookie("queue-csid")
 	secret, err1 := c.Cookie("queue-secret")
 	if err != nil || err1 != nil || CSid == "" || !IsValidCSid(CSid) || !CheckSecretForCSid(secret, CSid) {
+		CSid = ""
+	}
+	c.Set(studentCSidKey, CSid)
+	return CSid
+}
+
+// Key under which studentCSid keeps its result in the gin context.
+const studentCSidKey = "studentCSid"
+
+func getCSIDFromCookie(c *gin.Context) string {
+	CSid := studentCSid(c)
+	if CSid == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
-		return ""
 	}
 	return CSid
 }
+
+// handleLanguage remembers the language the user picked, and takes them back
+// to the page they were on if it can be fetched again.
+func handleLanguage(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		locale := c.Query("lang")
+		if _, ok := catalogues[locale]; !ok {
+			c.String(http.StatusBadRequest, "Unknown language.")
+			return
+		}
+		c.SetCookie(localeCookie, locale, 365*24*60*60, "/", "", true, false)
+		next := "/"
+		if referer, err := url.Parse(c.GetHeader("Referer")); err == nil && referer.Host == c.Request.Host {
+			for _, route := range router.Routes() {
+				if route.Method == http.MethodGet && route.Path == path.Clean("/"+referer.Path) {
+					next = (&url.URL{Path: route.Path, RawQuery: referer.RawQuery}).String()
+				}
+			}
+		}
+		c.Redirect(http.StatusSeeOther, next)
+	}
+}
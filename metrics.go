@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file exposes metrics on /metrics, in the Prometheus text format.
+// We only need counters and histograms, so we write the format ourselves
+// rather than pulling in the Prometheus client library.
+
+// Histogram buckets, in seconds.
+var (
+	waitBuckets    = []float64{60, 120, 300, 600, 900, 1200, 1800, 2700, 3600, 5400, 7200}
+	serviceBuckets = []float64{60, 120, 180, 300, 420, 600, 900, 1200, 1800, 3600}
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+// A metric is a counter or a histogram that can write itself out.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter is a Prometheus counter, with one value per set of labels.
+type counter struct {
+	name   string
+	help   string
+	mutex  sync.Mutex
+	values map[string]float64 // Rendered labels -> value.
+}
+
+func newCounter(name string, help string) *counter {
+	c := &counter{name: name, help: help, values: map[string]float64{}}
+	metrics = append(metrics, c)
+	return c
+}
+
+// Inc adds one to the counter with the given labels, see metricLabels.
+func (c *counter) Inc(labels string) {
+	c.mutex.Lock()
+	c.values[labels]++
+	c.mutex.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, labels, formatMetric(c.values[labels]))
+	}
+}
+
+// histogram is a Prometheus histogram, with one series per set of labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Not cumulative, one per bucket.
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+	metrics = append(metrics, h)
+	return h
+}
+
+// Observe records value in the series with the given labels, see metricLabels.
+func (h *histogram) Observe(labels string, value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, ok := h.series[labels]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labelSets := make([]string, 0, len(h.series))
+	for labels := range h.series {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+	for _, labels := range labelSets {
+		series := h.series[labels]
+		prefix := labels
+		if prefix != "" {
+			prefix += ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatMetric(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, series.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, labels, formatMetric(series.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, series.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricLabels renders name/value pairs as Prometheus labels.
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(labels, ",")
+}
+
+// Every metric, in the order they are written out.
+var metrics []metric
+
+var (
+	joinsTotal       = newCounter("queue_joins_total", "Students who joined the queue.")
+	servesTotal      = newCounter("queue_serves_total", "Students who were picked by a TA.")
+	sessionsTotal    = newCounter("queue_group_sessions_total", "Group sessions, where a TA picked several students at once.")
+	bookingsTotal    = newCounter("queue_bookings_total", "Appointments students booked.")
+	rejectionsTotal  = newCounter("queue_rejections_total", "Students turned away for going over a help limit.")
+	earlyLeavesTotal = newCounter("queue_early_leaves_total", "Students who left the queue before being served.")
+	noShowsTotal     = newCounter("queue_no_shows_total", "Times a TA couldn't find a student, including those that got their ticket dropped.")
+	removalsTotal    = newCounter("queue_removals_total", "Tickets a TA removed without serving them, including duplicates merged into another.")
+	waitSeconds      = newHistogram("queue_wait_seconds", "Time between joining the queue and being picked by a TA.", waitBuckets)
+	serviceSeconds   = newHistogram("queue_service_seconds", "Estimated time a TA spent with a student, until they picked the next one.", serviceBuckets)
+	persistSeconds   = newHistogram("queue_persistence_write_seconds", "Time taken to write persistence.json.", latencyBuckets)
+	requestsTotal    = newCounter("http_requests_total", "HTTP requests served, by route and status code.")
+	requestSeconds   = newHistogram("http_request_duration_seconds", "Time taken to serve HTTP requests, by route.", latencyBuckets)
+	rateLimitedTotal = newCounter("http_rate_limited_total", "Requests turned away by the rate limits, by route and by whether the IP or CSid was limited.")
+)
+
+// MetricsNotifier updates the queue metrics as the queue changes.
+type MetricsNotifier struct {
+	lastServe   map[string]time.Time // TA -> when they picked their last student.
+	lastSession uint                 // The last group session students were picked for.
+}
+
+// NewMetricsNotifier returns a MetricsNotifier, ready to be registered.
+func NewMetricsNotifier() *MetricsNotifier {
+	return &MetricsNotifier{lastServe: map[string]time.Time{}}
+}
+
+// Notify implements Notifier.
+func (n *MetricsNotifier) Notify(event QueueEvent) {
+	labels := metricLabels("queue", DefaultQueueID)
+	switch event.Kind {
+	case EventJoined:
+		joinsTotal.Inc(labels)
+	case EventRejected:
+		rejectionsTotal.Inc(labels)
+	case EventBooked:
+		bookingsTotal.Inc(labels)
+	case EventLeft:
+		earlyLeavesTotal.Inc(labels)
+	case EventRemoved, EventMerged:
+		removalsTotal.Inc(labels)
+	case EventNoShow, EventDropped:
+		noShowsTotal.Inc(labels)
+	case EventServed:
+		servesTotal.Inc(labels)
+		entry := event.Entry
+		waitSeconds.Observe(labels, entry.ServedAt.Sub(entry.JoinedAt).Seconds())
+		if entry.SessionID != 0 && entry.SessionID != n.lastSession {
+			sessionsTotal.Inc(labels)
+			n.lastSession = entry.SessionID
+		}
+		// See maxHelpDuration in stats.go. Students in a group session are
+		// all picked at once.
+		if last, ok := n.lastServe[entry.ServedBy]; ok && entry.ServedAt.After(last) && entry.ServedAt.Sub(last) <= maxHelpDuration {
+			serviceSeconds.Observe(labels, entry.ServedAt.Sub(last).Seconds())
+		}
+		n.lastServe[entry.ServedBy] = entry.ServedAt
+	}
+}
+
+// WriteMetrics writes every metric to w, in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	labels := metricLabels("queue", DefaultQueueID)
+	open := 0
+	if IsQueueOpen() {
+		open = 1
+	}
+	fmt.Fprintf(w, "# HELP queue_length Students waiting in the queue.\n# TYPE queue_length gauge\n")
+	fmt.Fprintf(w, "queue_length{%s} %d\n", labels, len(UnservedEntries()))
+	fmt.Fprintf(w, "# HELP queue_open Whether the queue is open.\n# TYPE queue_open gauge\n")
+	fmt.Fprintf(w, "queue_open{%s} %d\n", labels, open)
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// The methods requests are labelled with. Any other method is labelled
+// "other", so that clients can't create new series by making them up.
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodConnect: true,
+	http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// MetricsMiddleware records the number and duration of HTTP requests.
+// Requests are labelled with the route they matched, rather than their path,
+// so that random URLs don't create new series.
+func MetricsMiddleware(router *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	routes := map[string]bool{}
+	var prefixes []string
+	return func(c *gin.Context) {
+		once.Do(func() {
+			for _, route := range router.Routes() {
+				if i := strings.Index(route.Path, "*"); i >= 0 {
+					prefixes = append(prefixes, route.Path[:i])
+				}
+				routes[route.Path] = true
+			}
+		})
+		start := time.Now()
+		c.Next()
+		route := "unmatched"
+		if routes[c.Request.URL.Path] {
+			route = c.Request.URL.Path
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(c.Request.URL.Path, prefix) {
+				route = prefix + "*"
+			}
+		}
+		method := "other"
+		if metricMethods[c.Request.Method] {
+			method = c.Request.Method
+		}
+		requestsTotal.Inc(metricLabels("method", method, "route", route,
+			"status", strconv.Itoa(c.Writer.Status())))
+		requestSeconds.Observe(metricLabels("method", method, "route", route),
+			time.Since(start).Seconds())
+	}
+}
+
+// CanReadMetrics returns whether the request presents the metrics token
+// (as a bearer token), or comes from an address in the metrics allowlist.
+// The allowlist is checked against the address of the TCP connection, so
+// X-Forwarded-For headers can't be used to get around it.
+func CanReadMetrics(r *http.Request) bool {
+	cfg := CurrentConfig()
+	if cfg.MetricsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) == 1 {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return inNetworks(net.ParseIP(host), cfg.MetricsAllowedIPs)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &histogram{name: "test_seconds", help: "Test.", buckets: []float64{1, 5}, series: map[string]*histogramSeries{}}
+	labels := metricLabels("queue", "default")
+	h.Observe(labels, 0.5)
+	h.Observe(labels, 3)
+	h.Observe(labels, 60)
+	var buf bytes.Buffer
+	h.write(&buf)
+	require.Equal(t, `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{queue="default",le="1"} 1
+test_seconds_bucket{queue="default",le="5"} 2
+test_seconds_bucket{queue="default",le="+Inf"} 3
+test_seconds_sum{queue="default"} 63.5
+test_seconds_count{queue="default"} 3
+`, buf.String())
+}
+
+func TestMetricsNotifier(t *testing.T) {
+	n := NewMetricsNotifier()
+	joined := time.Now().Add(-10 * time.Minute)
+	first := QueueEntry{CSid: "r3a1b", JoinedAt: joined, ServedAt: joined.Add(5 * time.Minute), ServedBy: "ta1"}
+	second := QueueEntry{CSid: "r3a2b", JoinedAt: joined, ServedAt: joined.Add(8 * time.Minute), ServedBy: "ta1"}
+	n.Notify(QueueEvent{Kind: EventJoined, Entry: first})
+	n.Notify(QueueEvent{Kind: EventServed, Entry: first})
+	n.Notify(QueueEvent{Kind: EventServed, Entry: second})
+	n.Notify(QueueEvent{Kind: EventRejected})
+	n.Notify(QueueEvent{Kind: EventBooked, Booking: Booking{ID: 1}})
+	n.Notify(QueueEvent{Kind: EventRemoved})
+	grouped := QueueEntry{CSid: "r3a3b", JoinedAt: joined, ServedAt: second.ServedAt, ServedBy: "ta2", SessionID: 1}
+	n.Notify(QueueEvent{Kind: EventServed, Entry: grouped})
+	grouped.CSid = "r3a4b"
+	n.Notify(QueueEvent{Kind: EventServed, Entry: grouped})
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+	require.Contains(t, out, `queue_serves_total{queue="default"} 4`)
+	require.Contains(t, out, `queue_rejections_total{queue="default"} 1`)
+	require.Contains(t, out, `queue_bookings_total{queue="default"} 1`)
+	require.Contains(t, out, `queue_removals_total{queue="default"} 1`)
+	require.Contains(t, out, `queue_group_sessions_total{queue="default"} 1`)
+	require.Contains(t, out, `queue_wait_seconds_sum{queue="default"} 1740`)
+	// The service time is the gap between the serves, once per group session.
+	require.Contains(t, out, `queue_service_seconds_sum{queue="default"} 180`)
+	require.Contains(t, out, `queue_open{queue="default"}`)
+}
+
+func TestCanReadMetrics(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	SetConfig(Config{MetricsToken: "secret", MetricsAllowedIPs: []string{"10.0.0.0/8"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	require.False(t, CanReadMetrics(req))
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	require.False(t, CanReadMetrics(req))
+	req.Header.Set("Authorization", "Bearer wrong")
+	require.False(t, CanReadMetrics(req))
+	req.Header.Set("Authorization", "Bearer secret")
+	require.True(t, CanReadMetrics(req))
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	require.True(t, CanReadMetrics(req))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MetricsMiddleware(router))
+	router.GET("/metrics-test", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, method := range []string{http.MethodGet, "MADEUP"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/metrics-test", nil))
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/random-path", nil))
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf)
+	out := buf.String()
+	require.Contains(t, out, `method="GET",route="/metrics-test",status="200"`)
+	require.Contains(t, out, `method="other",route="/metrics-test"`)
+	require.Contains(t, out, `method="GET",route="unmatched"`)
+	require.NotContains(t, out, "MADEUP")
+	require.NotContains(t, out, "random-path")
+}
@@ -12,12 +12,63 @@ import (
 // tickets, but only one has WasServed set to true. We store all tickets
 // so that we can compute statistics later by parsing the persistence.json file.
 type QueueEntry struct {
-	CSid      string
-	Name      string
-	TaskInfo  string
-	JoinedAt  time.Time
-	WasServed bool
-	ServedAt  time.Time
+	ID         uint // Unique ticket number, assigned when joining.
+	CSid       string
+	Name       string
+	TaskInfo   string
+	Category   string      // What the question is about, see categories.go.
+	LabSection string      // One of Config.LabSections, see ordering.go.
+	Where      Whereabouts // Where the student is, see whereabouts.go.
+	JoinedAt   time.Time
+	WasServed  bool
+	ServedAt   time.Time
+	ServedBy   string            // Username of the TA who served the student.
+	TAWhere    Whereabouts       // Where the TA who served the student was at the time.
+	SessionID  uint              // The group session the student was served in, if any.
+	LeftEarly  bool              // Whether the student left the queue before being served.
+	Email      string            // Empty unless the student opted in to email notifications.
+	Push       *PushSubscription // nil unless the student opted in to push notifications.
+	Locale     string            // Language of the notifications, see i18n.go.
+
+	// Set when the ticket is for an appointment, see appointments.go.
+	// Appointments go ahead of everybody who walked in.
+	BookingID       uint
+	AppointmentWith string // Username of the TA the student booked.
+
+	// Set when a TA took the ticket off the queue without serving it, see
+	// RemoveTicket and MergeTickets. Removed tickets don't count towards
+	// MaxNumTimesHelped.
+	Removed       bool
+	RemovedAt     time.Time
+	RemovedBy     string // Username of the TA who removed the ticket.
+	RemovalReason string
+	MergedInto    uint // ID of the ticket this one was a duplicate of, if any.
+
+	// Set when the student stepped away, see NoShow and Snooze.
+	NoShows         uint      // How many times a TA came by and couldn't find the student.
+	DeferredUntil   time.Time // Everybody goes ahead of the ticket until then.
+	DroppedAsNoShow bool      // Removed after MaxNoShows no-shows.
+
+	// Set when a TA moved the ticket, see MoveTicket. The ticket then goes
+	// right behind the last of the tickets in PlacedBehind that are still
+	// waiting, whatever the ordering policy.
+	Placed       bool
+	PlacedBehind []uint // IDs of the tickets that were ahead of it.
+
+	// Set by the retention policy once the ticket has been stripped of
+	// personal information. CSid then holds a pseudonym.
+	Anonymised bool
+}
+
+// IsWaiting returns whether the ticket is still in the queue.
+func (e QueueEntry) IsWaiting() bool {
+	return !e.WasServed && !e.Removed
+}
+
+// IsDeferred returns whether everybody goes ahead of the ticket at now, see
+// deferLocked.
+func (e QueueEntry) IsDeferred(now time.Time) bool {
+	return e.DeferredUntil.After(now)
 }
 
 // Queue is the underlying thread-safe data structure (mutex + queue).
@@ -25,34 +76,63 @@ type Queue struct {
 	Mutex   sync.Mutex   // To handle concurrency, prevents multiple users from touching the DS.
 	Entries []QueueEntry // Contains the actual tickets.
 	IsOpen  bool         // Whether the queue is open or closed.
+	NextID  uint         // ID of the next ticket. IDs start at 1.
+
+	Sessions      []Session // Every group session, see sessions.go.
+	NextSessionID uint      // ID of the next session. IDs start at 1.
+
+	TAWhereabouts map[string]Whereabouts // Where each TA is, by username.
+
+	Categories   []string            // What students can pick from, see categories.go.
+	TACategories map[string][]string // The categories each TA subscribed to, by username.
+	Ordering     OrderingSettings    // How waiting students are ordered, see ordering.go.
+
+	Availability  []AvailabilityBlock // When TAs can be booked, see appointments.go.
+	Bookings      []Booking           // Every booking, including cancelled ones.
+	LastBlockID   uint                // ID of the last availability block. IDs start at 1.
+	LastBookingID uint                // ID of the last booking. IDs start at 1.
 }
 
+// ID of the queue. There is a single queue for now, but metrics, logs and
+// settings refer to it by ID so that more can be added later.
+const DefaultQueueID = "default"
+
 // Main in-memory data structure.
-var queue = Queue{Entries: []QueueEntry{}, IsOpen: false}
+var queue = Queue{Entries: []QueueEntry{}, IsOpen: false, NextID: 1, NextSessionID: 1}
 
-// JoinQueue adds the student with name and CSid to the queue.
+// JoinQueue adds ticket to the queue. The student fills in the ticket's
+// CSid, Name, TaskInfo, Category, LabSection and Where, and Email (left empty
+// if they did not opt in to notifications) and Locale, the language
+// notifications are sent in.
 // Returns how many students are ahead of the new student in the queue,
 // and the estimated wait time in seconds.
-// If the student has requested help more than MaxNumTimesHelped,
-// returns how many times the students has asked for help already, and -1
-func JoinQueue(name string, CSid string, taskInfo string) (uint, int) {
-	timesHelped := NumTimesHelped(CSid)
-	if timesHelped < config.MaxNumTimesHelped {
-		entry := QueueEntry{CSid, name, taskInfo, time.Now(), false, time.Now()}
-		queue.Mutex.Lock()
-		// How many un-served students joined before me?
-		var rsf uint = 0
-		for _, entry := range queue.Entries {
-			if !entry.WasServed {
-				rsf++
-			}
-		}
-		queue.Entries = append(queue.Entries, entry)
-		UpdateDiskCopy()
+// If a help limit keeps the student from joining, returns 0, -1 and the
+// limit, see limits.go.
+func JoinQueue(ticket QueueEntry) (uint, int, HelpLimit) {
+	now := time.Now()
+	queue.Mutex.Lock()
+	if limit, over := helpLimitLocked(ticket, now); over {
+		publishQueueEvent(EventRejected, QueueEntry{CSid: ticket.CSid, Name: ticket.Name, TaskInfo: ticket.TaskInfo, Category: ticket.Category, JoinedAt: now})
 		queue.Mutex.Unlock()
-		return rsf, int(EstimatedWaitTime())
+		return 0, -1, limit
+	}
+	ticket.JoinedAt = now
+	ticket.ServedAt = now
+	ticket.ID = queue.NextID
+	queue.NextID++
+	queue.Entries = append(queue.Entries, ticket)
+	// How many students are ahead of me, given the ordering policy?
+	var rsf uint = 0
+	for _, entry := range unservedEntriesLocked() {
+		if entry.ID == ticket.ID {
+			break
+		}
+		rsf++
 	}
-	return timesHelped, -1
+	UpdateDiskCopy()
+	publishQueueEvent(EventJoined, ticket)
+	queue.Mutex.Unlock()
+	return rsf, int(EstimatedWaitTime()), HelpLimit{}
 }
 
 // HasJoinedQueue returns true if the user with given CSid has joined the queue
@@ -60,7 +140,7 @@ func JoinQueue(name string, CSid string, taskInfo string) (uint, int) {
 func HasJoinedQueue(CSid string) bool {
 	queue.Mutex.Lock()
 	for _, entry := range queue.Entries {
-		if entry.CSid == CSid && !entry.WasServed {
+		if entry.CSid == CSid && entry.IsWaiting() {
 			queue.Mutex.Unlock()
 			return true
 		}
@@ -69,30 +149,422 @@ func HasJoinedQueue(CSid string) bool {
 	return false
 }
 
-// ServeStudent marks the student with given CSid as served.
-func ServeStudent(CSid string) {
+// WaitingTicket returns the ticket the student with given CSid is waiting
+// with, if there is one.
+func WaitingTicket(CSid string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	for _, entry := range queue.Entries {
+		if entry.CSid == CSid && entry.IsWaiting() {
+			queue.Mutex.Unlock()
+			return entry, true
+		}
+	}
+	queue.Mutex.Unlock()
+	return QueueEntry{}, false
+}
+
+// ServeStudent marks the student with given CSid as served by the given TA,
+// which ends any group session the TA was running. Returns the ticket that
+// was served, if the student was waiting.
+func ServeStudent(CSid string, TA string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	entry, found := markServed(CSid, TA, false)
+	if found {
+		endSessionsLocked(TA, entry.ServedAt)
+		publishQueueEvent(EventServed, entry)
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, found
+}
+
+// TakeNext serves the student at the front of the queue on behalf of TA,
+// among those in the categories TA subscribed to, if any. Tickets that are
+// deferred for a while, and appointments with other TAs, are skipped, but
+// appointments with TA are taken whatever their category. Picking and serving the ticket happen
+// under the same lock, so two TAs taking the next student at once always get
+// different students. Returns the ticket that was served, if any.
+func TakeNext(TA string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	now := time.Now()
+	categories := queue.TACategories[TA]
+	for _, next := range unservedEntriesLocked() {
+		if next.IsDeferred(now) || (next.AppointmentWith != TA && !InCategories(next, categories)) ||
+			(next.AppointmentWith != "" && next.AppointmentWith != TA) {
+			continue
+		}
+		entry, _ := markServed(next.CSid, TA, false)
+		endSessionsLocked(TA, entry.ServedAt)
+		publishQueueEvent(EventServed, entry)
+		UpdateDiskCopy()
+		return entry, true
+	}
+	return QueueEntry{}, false
+}
+
+// CurrentlyHelping returns the ticket TA is helping, that is, the last
+// ticket they served on its own, less than maxClaimDuration ago.
+func CurrentlyHelping(TA string, now time.Time) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	var latest QueueEntry
+	for _, entry := range queue.Entries {
+		if entry.WasServed && entry.ServedBy == TA && !entry.ServedAt.Before(latest.ServedAt) {
+			latest = entry
+		}
+	}
+	if latest.ServedBy == "" || latest.SessionID != 0 || now.Sub(latest.ServedAt) > maxClaimDuration {
+		return QueueEntry{}, false
+	}
+	return latest, true
+}
+
+// LeaveQueue removes the student with given CSid from the queue at their
+// own request. The ticket is stored like a served one, with LeftEarly set.
+// Returns the ticket that was left, if the student was waiting.
+func LeaveQueue(CSid string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	entry, found := markServed(CSid, "", true)
+	if found {
+		publishQueueEvent(EventLeft, entry)
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, found
+}
+
+// RemoveTicket takes the waiting ticket with given ID off the queue, for
+// instance because it is spam. Unlike ServeStudent, this doesn't count as
+// help, nor towards the statistics. Returns the ticket that was removed, if
+// it was waiting.
+func RemoveTicket(ID uint, TA string, reason string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	i := waitingIndex(ID)
+	if i < 0 {
+		queue.Mutex.Unlock()
+		return QueueEntry{}, false
+	}
+	markRemoved(i, TA, reason)
+	entry := queue.Entries[i]
+	publishQueueEvent(EventRemoved, entry)
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, true
+}
+
+// MoveTicket moves the waiting ticket with given ID to position in the
+// queue, 0 being the front, for instance to give a student who lost their
+// connection their place back. Positions past the end move the ticket to
+// the back. Returns the ticket that was moved, if it was waiting.
+func MoveTicket(ID uint, position uint) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	i := waitingIndex(ID)
+	if i < 0 {
+		queue.Mutex.Unlock()
+		return QueueEntry{}, false
+	}
+	entry := moveLocked(i, position)
+	publishQueueEvent(EventMoved, entry)
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, true
+}
+
+// EditTicket replaces the name and task of the waiting ticket with given
+// ID, for instance to fix a typo. Returns the edited ticket, if it was
+// waiting.
+func EditTicket(ID uint, name string, taskInfo string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	i := waitingIndex(ID)
+	if i < 0 {
+		queue.Mutex.Unlock()
+		return QueueEntry{}, false
+	}
+	queue.Entries[i].Name = name
+	queue.Entries[i].TaskInfo = taskInfo
+	entry := queue.Entries[i]
+	publishQueueEvent(EventEdited, entry)
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, true
+}
+
+// MergeTickets merges the waiting ticket duplicateID into the waiting ticket
+// intoID, for students who joined twice (say, with a mistyped CS ID). The
+// kept ticket takes whichever place in the queue is ahead, and the earlier
+// join time. The duplicate is removed, with MergedInto set. Returns the kept
+// ticket, if both tickets were waiting.
+func MergeTickets(duplicateID uint, intoID uint, TA string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	dup, into := waitingIndex(duplicateID), waitingIndex(intoID)
+	if dup < 0 || into < 0 || dup == into {
+		queue.Mutex.Unlock()
+		return QueueEntry{}, false
+	}
+	markRemoved(dup, TA, "")
+	queue.Entries[dup].MergedInto = intoID
+	duplicate, kept := queue.Entries[dup], queue.Entries[into]
+	if duplicate.JoinedAt.Before(kept.JoinedAt) {
+		kept.JoinedAt = duplicate.JoinedAt
+	}
+	if kept.Email == "" {
+		kept.Email = duplicate.Email
+	}
+	if kept.Push == nil {
+		kept.Push = duplicate.Push
+	}
+	if dup < into {
+		kept.Placed, kept.PlacedBehind = duplicate.Placed, duplicate.PlacedBehind
+		for j, entry := range queue.Entries {
+			for k, ID := range entry.PlacedBehind {
+				if ID == duplicateID {
+					queue.Entries[j].PlacedBehind[k] = intoID
+				}
+			}
+		}
+		queue.Entries[dup], queue.Entries[into] = kept, duplicate
+	} else {
+		queue.Entries[into] = kept
+	}
+	publishQueueEvent(EventMerged, duplicate)
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return kept, true
+}
+
+// NoShow records that TA came by the waiting ticket with given ID, and
+// couldn't find the student. The ticket is deferred, see deferLocked, or
+// dropped once it has MaxNoShows no-shows, with DroppedAsNoShow set.
+// Returns the ticket, if it was waiting.
+func NoShow(ID uint, TA string) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	i := waitingIndex(ID)
+	if i < 0 {
+		queue.Mutex.Unlock()
+		return QueueEntry{}, false
+	}
+	queue.Entries[i].NoShows++
+	var entry QueueEntry
+	if max := CurrentConfig().MaxNoShows; max > 0 && queue.Entries[i].NoShows >= max {
+		markRemoved(i, TA, "")
+		queue.Entries[i].DroppedAsNoShow = true
+		entry = queue.Entries[i]
+		publishQueueEvent(EventDropped, entry)
+	} else {
+		entry = deferLocked(i, time.Now())
+		publishQueueEvent(EventNoShow, entry)
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return entry, true
+}
+
+// Snooze lets others go ahead of the student with given CSid, when they
+// need to step away. The ticket is deferred like for a no-show, see
+// deferLocked, but this doesn't count as one. Returns the ticket, if the
+// student was waiting.
+func Snooze(CSid string) (QueueEntry, bool) {
 	queue.Mutex.Lock()
 	for i, entry := range queue.Entries {
-		if entry.CSid == CSid {
-			if !entry.WasServed {
-				queue.Entries[i].ServedAt = time.Now()
+		if entry.CSid == CSid && entry.IsWaiting() {
+			entry = deferLocked(i, time.Now())
+			publishQueueEvent(EventSnoozed, entry)
+			UpdateDiskCopy()
+			queue.Mutex.Unlock()
+			return entry, true
+		}
+	}
+	queue.Mutex.Unlock()
+	return QueueEntry{}, false
+}
+
+// deferLocked moves the ticket at index i DeferPositions places back, or
+// puts it behind everybody for DeferMinutes, after which it gets its place
+// back. Returns the deferred ticket.
+// The caller of this function should have locked the mutex before calling it.
+func deferLocked(i int, now time.Time) QueueEntry {
+	config := CurrentConfig()
+	if config.DeferMinutes > 0 {
+		queue.Entries[i].DeferredUntil = now.Add(time.Duration(config.DeferMinutes) * time.Minute)
+		return queue.Entries[i]
+	}
+	var position uint = 0
+	for _, entry := range unservedEntriesLocked() {
+		if entry.ID == queue.Entries[i].ID {
+			break
+		}
+		position++
+	}
+	return moveLocked(i, position+config.DeferPositions)
+}
+
+// moveLocked moves the ticket at index i to position in the queue, see
+// MoveTicket. Tickets can't be moved behind deferred ones, which are going
+// back to their place, and the ticket itself stops being deferred. The
+// ticket is placed, see QueueEntry.Placed, so that it stays there whatever
+// the ordering policy. Returns the moved ticket.
+// The caller of this function should have locked the mutex before calling it.
+func moveLocked(i int, position uint) QueueEntry {
+	now := time.Now()
+	entry := queue.Entries[i]
+	entry.DeferredUntil = time.Time{}
+	queue.Entries = append(queue.Entries[:i], queue.Entries[i+1:]...)
+	waiting := unservedEntriesLocked()
+	end := len(waiting)
+	for end > 0 && waiting[end-1].IsDeferred(now) {
+		end--
+	}
+	if position > uint(end) {
+		position = uint(end)
+	}
+	entry.Placed = true
+	entry.PlacedBehind = nil
+	for _, ahead := range waiting[:position] {
+		entry.PlacedBehind = append(entry.PlacedBehind, ahead.ID)
+	}
+	// Other placed tickets now go behind the ticket if they are behind its
+	// new place, and don't have to otherwise.
+	behind := map[uint]bool{}
+	for _, other := range waiting[position:end] {
+		behind[other.ID] = true
+	}
+	for j, other := range queue.Entries {
+		if !other.Placed || !other.IsWaiting() {
+			continue
+		}
+		placedBehind := []uint{}
+		for _, ID := range other.PlacedBehind {
+			if ID != entry.ID {
+				placedBehind = append(placedBehind, ID)
 			}
+		}
+		if behind[other.ID] {
+			placedBehind = append(placedBehind, entry.ID)
+		}
+		queue.Entries[j].PlacedBehind = placedBehind
+	}
+	at := len(queue.Entries)
+	if int(position) < end {
+		at = waitingIndex(waiting[position].ID)
+	}
+	queue.Entries = append(queue.Entries[:at], append([]QueueEntry{entry}, queue.Entries[at:]...)...)
+	return entry
+}
+
+// waitingIndex returns the index in queue.Entries of the waiting ticket with
+// given ID, or -1 if there is none.
+// The caller of this function should have locked the mutex before calling it.
+func waitingIndex(ID uint) int {
+	for i, entry := range queue.Entries {
+		if entry.ID == ID && entry.IsWaiting() {
+			return i
+		}
+	}
+	return -1
+}
+
+// markRemoved records that TA removed the ticket at index i.
+// The caller of this function should have locked the mutex before calling it.
+func markRemoved(i int, TA string, reason string) {
+	queue.Entries[i].Removed = true
+	queue.Entries[i].RemovedAt = time.Now()
+	queue.Entries[i].RemovedBy = TA
+	queue.Entries[i].RemovalReason = reason
+}
+
+// assignTicketIDs numbers the tickets that were stored before tickets had
+// IDs, and makes sure NextID is past every existing ID.
+// The caller of this function should have locked the mutex before calling it.
+func assignTicketIDs() {
+	for _, entry := range queue.Entries {
+		if entry.ID >= queue.NextID {
+			queue.NextID = entry.ID + 1
+		}
+	}
+	for i := range queue.Entries {
+		if queue.Entries[i].ID == 0 {
+			queue.Entries[i].ID = queue.NextID
+			queue.NextID++
+		}
+	}
+}
+
+// markServed marks every ticket of the given CSid as served. Returns the
+// ticket that was still waiting, if there was one. Tickets that were already
+// served are left untouched.
+// The caller of this function should have locked the mutex before calling it.
+func markServed(CSid string, TA string, leftEarly bool) (QueueEntry, bool) {
+	var waiting QueueEntry
+	found := false
+	for i, entry := range queue.Entries {
+		if entry.CSid == CSid && entry.IsWaiting() {
+			queue.Entries[i].ServedAt = time.Now()
 			queue.Entries[i].WasServed = true
+			queue.Entries[i].ServedBy = TA
+			queue.Entries[i].TAWhere = queue.TAWhereabouts[TA]
+			queue.Entries[i].LeftEarly = leftEarly
+			waiting, found = queue.Entries[i], true
+		}
+	}
+	return waiting, found
+}
+
+// SetPushSubscription attaches sub to the ticket of the given CSid, so that
+// push notifications can be sent to the student's browser. A nil sub turns
+// push notifications off. Returns false if the CSid isn't waiting in the queue.
+func SetPushSubscription(CSid string, sub *PushSubscription) bool {
+	queue.Mutex.Lock()
+	for i, entry := range queue.Entries {
+		if entry.CSid == CSid && entry.IsWaiting() {
+			queue.Entries[i].Push = sub
+			UpdateDiskCopy()
+			queue.Mutex.Unlock()
+			return true
 		}
 	}
-	UpdateDiskCopy()
 	queue.Mutex.Unlock()
+	return false
 }
 
 // UnservedEntries returns all tickets that have not been served yet.
 func UnservedEntries() []QueueEntry {
-	var acc []QueueEntry
 	queue.Mutex.Lock()
+	acc := unservedEntriesLocked()
+	queue.Mutex.Unlock()
+	return acc
+}
+
+// unservedEntriesLocked is UnservedEntries for callers that have already
+// locked the mutex. Tickets are ordered by the queue's ordering policy,
+// except those TAs moved, and deferred tickets come last.
+func unservedEntriesLocked() []QueueEntry {
+	var appointments, acc, placed, deferred []QueueEntry
+	now := time.Now()
 	for _, entry := range queue.Entries {
-		if !entry.WasServed {
+		if !entry.IsWaiting() {
+			continue
+		}
+		if entry.IsDeferred(now) {
+			deferred = append(deferred, entry)
+		} else if entry.BookingID != 0 {
+			appointments = append(appointments, entry)
+		} else if entry.Placed {
+			placed = append(placed, entry)
+		} else {
 			acc = append(acc, entry)
 		}
 	}
+	queue.Ordering.Policy().Order(acc, queue.Entries, now)
+	acc = insertPlaced(acc, placed)
+	return append(append(appointments, acc...), deferred...)
+}
+
+// AllEntries returns a copy of every ticket ever created, served or not.
+func AllEntries() []QueueEntry {
+	queue.Mutex.Lock()
+	acc := make([]QueueEntry, len(queue.Entries))
+	copy(acc, queue.Entries)
 	queue.Mutex.Unlock()
 	return acc
 }
@@ -102,7 +574,7 @@ func NumTimesHelped(CSid string) uint {
 	var acc uint = 0
 	queue.Mutex.Lock()
 	for _, entry := range queue.Entries {
-		if entry.CSid == CSid && entry.WasServed && entry.ServedAt.After(time.Now().AddDate(0, 0, -1)) {
+		if entry.CSid == CSid && helpedSince(entry, time.Now().AddDate(0, 0, -1)) {
 			acc++
 		}
 	}
@@ -110,6 +582,12 @@ func NumTimesHelped(CSid string) uint {
 	return acc
 }
 
+// helpedSince returns whether entry is a time its student was helped after
+// since, see NumTimesHelped. Students who left before being served weren't.
+func helpedSince(entry QueueEntry, since time.Time) bool {
+	return entry.WasServed && !entry.LeftEarly && entry.ServedAt.After(since)
+}
+
 // EstimatedWaitTime returns the estimated wait time in seconds for a students that joins the
 // queue right now, based on served entries from the past 30 minutes.
 func EstimatedWaitTime() float64 {
@@ -147,10 +625,16 @@ func QueuePositionForCSID(CSid string) (bool, uint) {
 }
 
 // Returns the total number of times students received help
-// throughout the term.
+// throughout the term. Removed tickets, and students who left before
+// being served, don't count.
 func TotalNumStudentsHelped() uint {
 	queue.Mutex.Lock()
-	tot := uint(len(queue.Entries))
+	tot := uint(0)
+	for _, entry := range queue.Entries {
+		if !entry.Removed && helpedSince(entry, time.Time{}) {
+			tot++
+		}
+	}
 	queue.Mutex.Unlock()
 	return tot
 }
@@ -166,7 +650,10 @@ func IsQueueOpen() bool {
 // Opens the queue, letting students join it.
 func OpenQueue() {
 	queue.Mutex.Lock()
-	queue.IsOpen = true
+	if !queue.IsOpen {
+		queue.IsOpen = true
+		publishQueueEvent(EventOpened, QueueEntry{})
+	}
 	queue.Mutex.Unlock()
 }
 
@@ -174,6 +661,9 @@ func OpenQueue() {
 // Closing the queue does not kick existing students out.
 func CloseQueue() {
 	queue.Mutex.Lock()
-	queue.IsOpen = false
+	if queue.IsOpen {
+		queue.IsOpen = false
+		publishQueueEvent(EventClosed, QueueEntry{})
+	}
 	queue.Mutex.Unlock()
 }
@@ -1,32 +1,38 @@
 package main
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBasicFunctionality(t *testing.T) {
-	config = ReadConfig()
+	cfg, _, err := LoadConfig(nil, func(string) string { return "" })
+	require.NoError(t, err)
+	SetConfig(cfg)
 	require.Zero(t, len(queue.Entries))
 	require.Zero(t, len(UnservedEntries()))
-	JoinQueue("Joe Student", "r3a1b", "Totally lost.")
-	JoinQueue("Diligent Student", "r3a2b", "Totally lost, again.")
+	JoinQueue(QueueEntry{Name: "Joe Student", CSid: "r3a1b", TaskInfo: "Totally lost.", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Diligent Student", CSid: "r3a2b", TaskInfo: "Totally lost, again.", Locale: DefaultLocale})
 	require.Equal(t, 2, len(queue.Entries))
 	require.Equal(t, 2, len(UnservedEntries()))
 	require.Equal(t, "r3a1b", queue.Entries[0].CSid)
 	require.Equal(t, "Joe Student", queue.Entries[0].Name)
 	require.Equal(t, "r3a2b", queue.Entries[1].CSid)
 	require.Equal(t, "Diligent Student", queue.Entries[1].Name)
+	require.Equal(t, queue.Entries[0].ID+1, queue.Entries[1].ID)
 	require.True(t, HasJoinedQueue("r3a1b"))
 	require.True(t, HasJoinedQueue("r3a2b"))
 	require.False(t, HasJoinedQueue("r3a3b"))
 	require.Zero(t, NumTimesHelped("r3a1b"))
 	require.Zero(t, NumTimesHelped("r3a2b"))
 	require.Zero(t, NumTimesHelped("r3a3b"))
-	ServeStudent("r3a3b") // Does nothing
+	ServeStudent("r3a3b", "ta1") // Does nothing
 	require.Equal(t, 2, len(queue.Entries))
 	require.Equal(t, 2, len(UnservedEntries()))
-	ServeStudent("r3a2b")
+	ServeStudent("r3a2b", "ta1")
 	require.Equal(t, 2, len(queue.Entries)) // Data remains in memory
 	require.Equal(t, 1, len(UnservedEntries()))
 	require.Equal(t, uint(1), NumTimesHelped("r3a2b"))
@@ -37,5 +43,213 @@ func TestBasicFunctionality(t *testing.T) {
 	exists2, position2 := QueuePositionForCSID("r3a2b")
 	require.False(t, exists2)
 	require.Zero(t, position2)
-	require.Equal(t, uint(2), TotalNumStudentsHelped())
+	require.Equal(t, uint(1), TotalNumStudentsHelped()) // Only r3a2b was served.
+	queue.Entries = append(queue.Entries,
+		QueueEntry{CSid: "r3a3b", WasServed: true, ServedAt: time.Now(), Removed: true},
+		QueueEntry{CSid: "r3a4b", WasServed: true, ServedAt: time.Now(), LeftEarly: true})
+	require.Equal(t, uint(1), TotalNumStudentsHelped())
+}
+
+func TestAssignTicketIDs(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	queue.Entries = []QueueEntry{{CSid: "r3a1b"}, {ID: 5, CSid: "r3a2b"}, {CSid: "r3a3b"}}
+	queue.NextID = 1
+	assignTicketIDs()
+	require.Equal(t, uint(6), queue.Entries[0].ID)
+	require.Equal(t, uint(5), queue.Entries[1].ID)
+	require.Equal(t, uint(7), queue.Entries[2].ID)
+	require.Equal(t, uint(8), queue.NextID)
+}
+
+func TestTicketActions(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	queue.Entries = []QueueEntry{}
+	waitingIDs := func() []uint {
+		IDs := []uint{}
+		for _, entry := range UnservedEntries() {
+			IDs = append(IDs, entry.ID)
+		}
+		return IDs
+	}
+	for _, CSid := range []string{"r3a1b", "r3a2b", "r3a3b", "r3a4b", "r3a5b"} {
+		JoinQueue(QueueEntry{Name: "Student", CSid: CSid, TaskInfo: "Lost.", Locale: DefaultLocale})
+	}
+	first := queue.Entries[0].ID
+	ID := func(i uint) uint { return first + i }
+	ServeStudent("r3a1b", "ta1")
+
+	// Moving a ticket doesn't reorder the ones that were served.
+	_, found := MoveTicket(ID(3), 0)
+	require.True(t, found)
+	require.Equal(t, []uint{ID(3), ID(1), ID(2), ID(4)}, waitingIDs())
+	MoveTicket(ID(3), 2)
+	require.Equal(t, []uint{ID(1), ID(2), ID(3), ID(4)}, waitingIDs())
+	MoveTicket(ID(1), 10)
+	require.Equal(t, []uint{ID(2), ID(3), ID(4), ID(1)}, waitingIDs())
+	_, found = MoveTicket(ID(0), 0) // Already served.
+	require.False(t, found)
+
+	entry, found := EditTicket(ID(2), "Fixed Name", "Still lost.")
+	require.True(t, found)
+	require.Equal(t, "Fixed Name", entry.Name)
+
+	// Removed tickets don't count as help.
+	entry, found = RemoveTicket(ID(2), "ta1", "Spam")
+	require.True(t, found)
+	require.True(t, entry.Removed)
+	require.False(t, entry.WasServed)
+	require.Equal(t, "Spam", entry.RemovalReason)
+	require.Equal(t, []uint{ID(3), ID(4), ID(1)}, waitingIDs())
+	require.False(t, HasJoinedQueue("r3a3b"))
+	require.Zero(t, NumTimesHelped("r3a3b"))
+	_, found = RemoveTicket(ID(2), "ta1", "Spam")
+	require.False(t, found)
+
+	// The kept ticket takes the place of the duplicate if it is ahead.
+	kept, found := MergeTickets(ID(4), ID(1), "ta1")
+	require.True(t, found)
+	require.Equal(t, ID(1), kept.ID)
+	require.Equal(t, []uint{ID(3), ID(1)}, waitingIDs())
+	for _, entry := range AllEntries() {
+		if entry.ID == ID(4) {
+			require.True(t, entry.Removed)
+			require.Equal(t, ID(1), entry.MergedInto)
+		}
+	}
+	_, found = MergeTickets(ID(3), ID(3), "ta1")
+	require.False(t, found)
+	require.Len(t, AllEntries(), 5)
+}
+
+func TestNoShowAndSnooze(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.DeferPositions = 2
+	cfg.MaxNoShows = 2
+	SetConfig(cfg)
+	queue.Entries = []QueueEntry{}
+	waitingCSids := func() []string {
+		CSids := []string{}
+		for _, entry := range UnservedEntries() {
+			CSids = append(CSids, entry.CSid)
+		}
+		return CSids
+	}
+	for _, CSid := range []string{"r3a1b", "r3a2b", "r3a3b", "r3a4b"} {
+		JoinQueue(QueueEntry{Name: "Student", CSid: CSid, TaskInfo: "Lost.", Locale: DefaultLocale})
+	}
+	first := queue.Entries[0].ID
+
+	entry, found := NoShow(first, "ta1")
+	require.True(t, found)
+	require.Equal(t, uint(1), entry.NoShows)
+	require.Equal(t, []string{"r3a2b", "r3a3b", "r3a1b", "r3a4b"}, waitingCSids())
+	_, found = Snooze("r3a2b") // Not a no-show.
+	require.True(t, found)
+	require.Equal(t, []string{"r3a3b", "r3a1b", "r3a2b", "r3a4b"}, waitingCSids())
+	require.Zero(t, UnservedEntries()[2].NoShows)
+
+	// The ticket is dropped on the second no-show, without counting as help.
+	entry, found = NoShow(first, "ta1")
+	require.True(t, found)
+	require.True(t, entry.DroppedAsNoShow)
+	require.True(t, entry.Removed)
+	require.Equal(t, []string{"r3a3b", "r3a2b", "r3a4b"}, waitingCSids())
+	require.Zero(t, NumTimesHelped("r3a1b"))
+	_, found = NoShow(first, "ta1")
+	require.False(t, found)
+
+	// Deferring by minutes puts the ticket behind everybody, until it gets
+	// its place back.
+	cfg.DeferMinutes = 5
+	SetConfig(cfg)
+	entry, _ = Snooze("r3a3b")
+	require.True(t, entry.IsDeferred(time.Now()))
+	require.Equal(t, []string{"r3a2b", "r3a4b", "r3a3b"}, waitingCSids())
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a5b", TaskInfo: "Lost.", Locale: DefaultLocale})
+	require.Equal(t, []string{"r3a2b", "r3a4b", "r3a5b", "r3a3b"}, waitingCSids())
+	for i := range queue.Entries {
+		queue.Entries[i].DeferredUntil = time.Now().Add(-time.Second)
+	}
+	require.Equal(t, []string{"r3a3b", "r3a2b", "r3a4b", "r3a5b"}, waitingCSids())
+}
+
+func TestTakeNext(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, categories []string, subscriptions map[string][]string) {
+		queue.Entries, queue.NextID = entries, nextID
+		queue.Categories, queue.TACategories = categories, subscriptions
+	}(queue.Entries, queue.NextID, queue.Categories, queue.TACategories)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.DeferMinutes = 5
+	SetConfig(cfg)
+	queue.Entries = []QueueEntry{}
+	queue.Categories, queue.TACategories = []string{"Lab 5", "Exam review"}, nil
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a1b", TaskInfo: "Lost.", Category: "Lab 5", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a2b", TaskInfo: "Lost.", Category: "Exam review", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a3b", TaskInfo: "Lost.", Category: "Lab 5", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a4b", TaskInfo: "Lost.", Category: "Lab 5", Locale: DefaultLocale})
+	Snooze("r3a1b")
+	SetTACategories("ta2", []string{"Exam review"})
+
+	_, helping := CurrentlyHelping("ta1", time.Now())
+	require.False(t, helping)
+	entry, found := TakeNext("ta1") // r3a1b stepped away.
+	require.True(t, found)
+	require.Equal(t, "r3a2b", entry.CSid)
+	require.Equal(t, "ta1", entry.ServedBy)
+	current, helping := CurrentlyHelping("ta1", time.Now())
+	require.True(t, helping)
+	require.Equal(t, entry.ID, current.ID)
+	_, found = TakeNext("ta2") // Nobody else is waiting for exam review.
+	require.False(t, found)
+	entry, _ = TakeNext("ta1")
+	require.Equal(t, "r3a3b", entry.CSid)
+	_, helping = CurrentlyHelping("ta1", time.Now().Add(2*time.Hour))
+	require.False(t, helping)
+}
+
+func TestTakeNextConcurrently(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+	}(queue.Entries, queue.NextID)
+	queue.Entries = []QueueEntry{}
+	const students = 50
+	for i := 0; i < students; i++ {
+		JoinQueue(QueueEntry{Name: "Student", CSid: fmt.Sprintf("r%04d", i), TaskInfo: "Lost.", Locale: DefaultLocale})
+	}
+
+	// TAs race each other for students until there are none left. Every
+	// student must be taken by exactly one TA.
+	taken := make(chan QueueEntry, students)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(TA string) {
+			defer wg.Done()
+			for {
+				entry, found := TakeNext(TA)
+				if !found {
+					return
+				}
+				taken <- entry
+			}
+		}(fmt.Sprintf("ta%d", i))
+	}
+	wg.Wait()
+	close(taken)
+	seen := map[uint]bool{}
+	for entry := range taken {
+		require.False(t, seen[entry.ID], "ticket %d was taken twice", entry.ID)
+		seen[entry.ID] = true
+	}
+	require.Len(t, seen, students)
+	require.Empty(t, UnservedEntries())
 }
@@ -0,0 +1,88 @@
+package main
+
+import "log/slog"
+
+// This file contains the plumbing used to tell other parts of the application
+// (for instance, the email notifier in email.go and the webhooks in
+// webhooks.go) about changes to the queue.
+
+// QueueEventKind identifies what happened to the queue.
+type QueueEventKind int
+
+const (
+	EventJoined           QueueEventKind = iota // A student joined the queue.
+	EventServed                                 // A TA claimed a student.
+	EventLeft                                   // A student left the queue on their own.
+	EventOpened                                 // A TA opened the queue. Entry is empty.
+	EventClosed                                 // A TA closed the queue. Entry is empty.
+	EventRejected                               // A student was turned away for a help limit, see limits.go.
+	EventRemoved                                // A TA removed a ticket without serving it.
+	EventMoved                                  // A TA moved a ticket to another place in the queue.
+	EventEdited                                 // A TA changed a ticket's name or task.
+	EventMerged                                 // A TA merged a duplicate ticket into another. Entry is the duplicate.
+	EventNoShow                                 // A TA couldn't find a student, and deferred their ticket.
+	EventDropped                                // A ticket was removed after too many no-shows.
+	EventSnoozed                                // A student let others go ahead of them.
+	EventBooked                                 // A student booked an appointment. Entry is empty.
+	EventBookingCancelled                       // A TA removed the availability an appointment was booked in. Entry is empty.
+)
+
+// A QueueEvent describes a single mutation of the queue. Waiting is a snapshot
+// of the unserved tickets, in queue order, taken right after the mutation.
+type QueueEvent struct {
+	Kind    QueueEventKind
+	Entry   QueueEntry
+	Session Session // The group session Entry was served in, if any.
+	Booking Booking // The booking, for EventBooked and EventBookingCancelled.
+	Waiting []QueueEntry
+}
+
+// A Notifier is told about every mutation of the queue.
+type Notifier interface {
+	Notify(event QueueEvent)
+}
+
+// How many events can pile up for a single notifier before we start dropping them.
+const notifierBacklog = 128
+
+// One channel per registered notifier.
+var notifierChannels []chan QueueEvent
+
+// RegisterNotifier subscribes n to queue events. Each notifier gets its own
+// goroutine, so it receives events in order, and a slow notifier (say, an
+// unresponsive mail server) never holds up the others or the HTTP handlers.
+// RegisterNotifier should only be called when starting the application.
+func RegisterNotifier(n Notifier) {
+	events := make(chan QueueEvent, notifierBacklog)
+	notifierChannels = append(notifierChannels, events)
+	go func() {
+		for event := range events {
+			n.Notify(event)
+		}
+	}()
+}
+
+// publishQueueEvent hands an event about entry to every registered notifier.
+// The caller of this function should have locked the mutex before calling it.
+func publishQueueEvent(kind QueueEventKind, entry QueueEntry) {
+	if len(notifierChannels) == 0 {
+		return
+	}
+	event := QueueEvent{Kind: kind, Entry: entry, Waiting: unservedEntriesLocked()}
+	if entry.SessionID != 0 {
+		event.Session, _ = sessionLocked(entry.SessionID)
+	}
+	publishEvent(event)
+}
+
+// publishEvent hands event to every registered notifier.
+func publishEvent(event QueueEvent) {
+	for _, events := range notifierChannels {
+		select {
+		case events <- event:
+		default:
+			slog.Warn("A notifier is falling behind, dropping queue event.", append(ticketAttrs(event.Entry),
+				"booking", event.Booking.ID)...)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// This file contains the policies deciding in which order waiting students
+// are helped. Instructors pick one for each queue from /admin/ordering.
+
+// An OrderingPolicy decides in which order waiting students are helped.
+type OrderingPolicy interface {
+	// Order sorts waiting, which is in the order students joined the queue
+	// or TAs moved them to, into the order they should be helped in.
+	// entries are all the tickets, to look up past visits.
+	Order(waiting []QueueEntry, entries []QueueEntry, now time.Time)
+}
+
+// Names of the built-in ordering policies.
+const (
+	OrderFIFO         = "fifo"          // First come, first served.
+	OrderFewestHelped = "fewest-helped" // Students helped the fewest times in the last 24 hours first.
+	OrderLabSection   = "lab-section"   // Students in OrderingSettings.PrioritySections first.
+	OrderRoundRobin   = "round-robin"   // One student from each category in turn.
+)
+
+// OrderingPolicies are the names of the built-in ordering policies.
+var OrderingPolicies = []string{OrderFIFO, OrderFewestHelped, OrderLabSection, OrderRoundRobin}
+
+// OrderingSettings is how instructors want a queue ordered.
+type OrderingSettings struct {
+	Name             string   // One of OrderingPolicies. Empty means OrderFIFO.
+	PrioritySections []string // For OrderLabSection, from Config.LabSections.
+}
+
+// Validate checks that the settings name a policy, with what it needs.
+func (settings OrderingSettings) Validate() error {
+	switch settings.Name {
+	case "", OrderFIFO, OrderFewestHelped, OrderRoundRobin:
+	case OrderLabSection:
+		if len(settings.PrioritySections) == 0 {
+			return fmt.Errorf("pick the lab sections that go first")
+		}
+	default:
+		return fmt.Errorf("unknown ordering policy %q", settings.Name)
+	}
+	for _, section := range settings.PrioritySections {
+		if !IsValidLabSection(section) {
+			return fmt.Errorf("unknown lab section %q", section)
+		}
+	}
+	return nil
+}
+
+// Policy returns the policy the settings describe.
+func (settings OrderingSettings) Policy() OrderingPolicy {
+	switch settings.Name {
+	case OrderFewestHelped:
+		return fewestHelpedPolicy{}
+	case OrderLabSection:
+		return labSectionPolicy{settings.PrioritySections}
+	case OrderRoundRobin:
+		return roundRobinPolicy{}
+	}
+	return fifoPolicy{}
+}
+
+// CurrentOrdering returns how the queue is ordered.
+func CurrentOrdering() OrderingSettings {
+	queue.Mutex.Lock()
+	settings := queue.Ordering
+	queue.Mutex.Unlock()
+	return settings
+}
+
+// SetOrdering changes how the queue is ordered.
+func SetOrdering(settings OrderingSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	queue.Mutex.Lock()
+	queue.Ordering = settings
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return nil
+}
+
+// IsValidLabSection returns whether section is one of Config.LabSections.
+func IsValidLabSection(section string) bool {
+	for _, s := range CurrentConfig().LabSections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+type fifoPolicy struct{}
+
+func (fifoPolicy) Order(waiting []QueueEntry, entries []QueueEntry, now time.Time) {}
+
+type fewestHelpedPolicy struct{}
+
+func (fewestHelpedPolicy) Order(waiting []QueueEntry, entries []QueueEntry, now time.Time) {
+	timesHelped := map[string]int{}
+	for _, entry := range entries {
+		if helpedSince(entry, now.AddDate(0, 0, -1)) {
+			timesHelped[entry.CSid]++
+		}
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return timesHelped[waiting[i].CSid] < timesHelped[waiting[j].CSid]
+	})
+}
+
+type labSectionPolicy struct {
+	sections []string
+}
+
+func (p labSectionPolicy) Order(waiting []QueueEntry, entries []QueueEntry, now time.Time) {
+	priority := map[string]bool{}
+	for _, section := range p.sections {
+		priority[section] = true
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return priority[waiting[i].LabSection] && !priority[waiting[j].LabSection]
+	})
+}
+
+type roundRobinPolicy struct{}
+
+// Order takes the first student of each category, then the second of each,
+// and so on. Students with the same turn keep their place relative to each
+// other.
+func (roundRobinPolicy) Order(waiting []QueueEntry, entries []QueueEntry, now time.Time) {
+	turn := map[uint]int{} // How many students of the same category are ahead, by ticket ID.
+	ahead := map[string]int{}
+	for _, entry := range waiting {
+		turn[entry.ID] = ahead[entry.Category]
+		ahead[entry.Category]++
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		return turn[waiting[i].ID] < turn[waiting[j].ID]
+	})
+}
+
+// insertPlaced inserts the tickets TAs moved into ordered, the other waiting
+// tickets in the order of the policy. Each goes right behind the last of
+// the tickets it was placed behind, see QueueEntry.PlacedBehind, or at the
+// front if they are all gone. Tickets are inserted after the placed tickets
+// they go behind.
+func insertPlaced(ordered []QueueEntry, placed []QueueEntry) []QueueEntry {
+	for len(placed) > 0 {
+		next := 0
+		for j, entry := range placed {
+			next = j
+			if !placedBehindAny(entry, placed) {
+				break
+			}
+		}
+		entry := placed[next]
+		placed = append(placed[:next:next], placed[next+1:]...)
+		at := 0
+		for k, other := range ordered {
+			if placedBehindAny(entry, []QueueEntry{other}) {
+				at = k + 1
+			}
+		}
+		ordered = append(ordered[:at:at], append([]QueueEntry{entry}, ordered[at:]...)...)
+	}
+	return ordered
+}
+
+// placedBehindAny returns whether entry was placed behind one of others.
+func placedBehindAny(entry QueueEntry, others []QueueEntry) bool {
+	for _, other := range others {
+		for _, ID := range entry.PlacedBehind {
+			if ID == other.ID && other.ID != entry.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
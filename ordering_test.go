@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func csids(entries []QueueEntry) []string {
+	acc := []string{}
+	for _, entry := range entries {
+		acc = append(acc, entry.CSid)
+	}
+	return acc
+}
+
+func TestOrderingPolicies(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.LabSections = []string{"L1A", "L1B", "L1C"}
+	SetConfig(cfg)
+
+	now := time.Now()
+	entries := []QueueEntry{
+		{ID: 1, CSid: "a", WasServed: true, ServedAt: now.Add(-time.Hour)},
+		{ID: 2, CSid: "a", WasServed: true, ServedAt: now.Add(-2 * time.Hour)},
+		{ID: 3, CSid: "b", WasServed: true, ServedAt: now.Add(-30 * time.Minute)},
+		{ID: 4, CSid: "c", WasServed: true, ServedAt: now.Add(-48 * time.Hour)},
+	}
+	waiting := func() []QueueEntry {
+		return []QueueEntry{
+			{ID: 5, CSid: "a", Category: "Lab 5", LabSection: "L1A"},
+			{ID: 6, CSid: "b", Category: "Lab 5", LabSection: "L1B"},
+			{ID: 7, CSid: "c", Category: "Lab 5", LabSection: "L1C"},
+			{ID: 8, CSid: "d", Category: "Exam review", LabSection: "L1B"},
+			{ID: 9, CSid: "e", Category: "Lab 5"},
+		}
+	}
+	for _, test := range []struct {
+		settings OrderingSettings
+		order    []string
+	}{
+		{OrderingSettings{}, []string{"a", "b", "c", "d", "e"}},
+		{OrderingSettings{Name: OrderFIFO}, []string{"a", "b", "c", "d", "e"}},
+		// c was last helped more than a day ago.
+		{OrderingSettings{Name: OrderFewestHelped}, []string{"c", "d", "e", "b", "a"}},
+		{OrderingSettings{Name: OrderLabSection, PrioritySections: []string{"L1B", "L1C"}}, []string{"b", "c", "d", "a", "e"}},
+		{OrderingSettings{Name: OrderRoundRobin}, []string{"a", "d", "b", "c", "e"}},
+	} {
+		require.NoError(t, test.settings.Validate())
+		w := waiting()
+		test.settings.Policy().Order(w, entries, now)
+		require.Equal(t, test.order, csids(w), test.settings.Name)
+	}
+
+	require.EqualError(t, OrderingSettings{Name: "random"}.Validate(), `unknown ordering policy "random"`)
+	require.EqualError(t, OrderingSettings{Name: OrderLabSection}.Validate(), "pick the lab sections that go first")
+	require.EqualError(t, OrderingSettings{Name: OrderLabSection, PrioritySections: []string{"L2A"}}.Validate(), `unknown lab section "L2A"`)
+}
+
+func TestQueueFollowsOrdering(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, ordering OrderingSettings) {
+		queue.Entries, queue.NextID, queue.Ordering = entries, nextID, ordering
+	}(queue.Entries, queue.NextID, queue.Ordering)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.LabSections = []string{"L1A", "L1B"}
+	SetConfig(cfg)
+	queue.Entries = []QueueEntry{}
+	queue.Ordering = OrderingSettings{}
+
+	JoinQueue(QueueEntry{Name: "First", CSid: "a1a1", TaskInfo: "Lost.", LabSection: "L1A", Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Second", CSid: "b2b2", TaskInfo: "Lost.", LabSection: "L1B", Locale: DefaultLocale})
+	ahead, _, _ := JoinQueue(QueueEntry{Name: "Third", CSid: "c3c3", TaskInfo: "Lost.", LabSection: "L1B", Locale: DefaultLocale})
+	require.Equal(t, uint(2), ahead)
+
+	require.Error(t, SetOrdering(OrderingSettings{Name: OrderLabSection}))
+	require.Equal(t, OrderingSettings{}, CurrentOrdering())
+	require.NoError(t, SetOrdering(OrderingSettings{Name: OrderLabSection, PrioritySections: []string{"L1B"}}))
+	require.Equal(t, []string{"b2b2", "c3c3", "a1a1"}, csids(UnservedEntries()))
+	_, position := QueuePositionForCSID("c3c3")
+	require.Equal(t, uint(1), position)
+	_, position = QueuePositionForCSID("a1a1")
+	require.Equal(t, uint(2), position)
+
+	// Newcomers are told where the policy puts them.
+	ahead, _, _ = JoinQueue(QueueEntry{Name: "Fourth", CSid: "d4d4", TaskInfo: "Lost.", LabSection: "L1B", Locale: DefaultLocale})
+	require.Equal(t, uint(2), ahead)
+
+	entry, found := TakeNext("ta1")
+	require.True(t, found)
+	require.Equal(t, "b2b2", entry.CSid)
+}
+
+func TestMovesOverrideOrdering(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, ordering OrderingSettings) {
+		queue.Entries, queue.NextID, queue.Ordering = entries, nextID, ordering
+	}(queue.Entries, queue.NextID, queue.Ordering)
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.LabSections = []string{"L1A", "L1B"}
+	cfg.DeferPositions = 1
+	SetConfig(cfg)
+
+	for _, test := range []struct {
+		settings OrderingSettings
+		order    []string
+	}{
+		{OrderingSettings{Name: OrderFIFO}, []string{"a", "b", "c", "d"}},
+		// a was helped an hour ago.
+		{OrderingSettings{Name: OrderFewestHelped}, []string{"b", "c", "d", "a"}},
+		{OrderingSettings{Name: OrderLabSection, PrioritySections: []string{"L1B"}}, []string{"b", "c", "d", "a"}},
+		{OrderingSettings{Name: OrderRoundRobin}, []string{"a", "c", "b", "d"}},
+	} {
+		now := time.Now()
+		queue.Entries = []QueueEntry{
+			{ID: 1, CSid: "a", JoinedAt: now.Add(-2 * time.Hour), WasServed: true, ServedAt: now.Add(-time.Hour)},
+			{ID: 2, CSid: "a", JoinedAt: now, Category: "Lab 5", LabSection: "L1A"},
+			{ID: 3, CSid: "b", JoinedAt: now, Category: "Lab 5", LabSection: "L1B"},
+			{ID: 4, CSid: "c", JoinedAt: now, Category: "Exam review", LabSection: "L1B"},
+			{ID: 5, CSid: "d", JoinedAt: now, Category: "Lab 5", LabSection: "L1B"},
+		}
+		queue.NextID = 6
+		queue.Ordering = test.settings
+		order := test.order
+		require.Equal(t, order, csids(UnservedEntries()), test.settings.Name)
+
+		// The last student is bumped to the front, and stays there when
+		// somebody the policy would put first joins.
+		last := waitingIDForCSid(t, order[3])
+		_, found := MoveTicket(last, 0)
+		require.True(t, found)
+		order = []string{order[3], order[0], order[1], order[2]}
+		require.Equal(t, order, csids(UnservedEntries()), test.settings.Name)
+		JoinQueue(QueueEntry{Name: "Newcomer", CSid: "e", TaskInfo: "Lost.", Category: "Exam review", LabSection: "L1B", Locale: DefaultLocale})
+		require.Equal(t, order[0], UnservedEntries()[0].CSid, test.settings.Name)
+		order = csids(UnservedEntries())
+
+		// Moving to a position puts the student there.
+		_, found = MoveTicket(waitingIDForCSid(t, order[0]), 2)
+		require.True(t, found)
+		require.Equal(t, order[0], UnservedEntries()[2].CSid, test.settings.Name)
+		order = csids(UnservedEntries())
+
+		// Students who aren't there go DeferPositions places back.
+		_, found = NoShow(waitingIDForCSid(t, order[0]), "ta1")
+		require.True(t, found)
+		require.Equal(t, order[0], UnservedEntries()[1].CSid, test.settings.Name)
+		order = csids(UnservedEntries())
+
+		// Students keep their place as those ahead of them are helped.
+		entry, found := TakeNext("ta1")
+		require.True(t, found)
+		require.Equal(t, order[0], entry.CSid, test.settings.Name)
+		require.Equal(t, order[1:], csids(UnservedEntries()), test.settings.Name)
+	}
+}
+
+// waitingIDForCSid returns the ID of the waiting ticket of the student.
+func waitingIDForCSid(t *testing.T, CSid string) uint {
+	for _, entry := range UnservedEntries() {
+		if entry.CSid == CSid {
+			return entry.ID
+		}
+	}
+	t.Fatal("No waiting ticket for", CSid)
+	return 0
+}
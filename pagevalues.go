@@ -2,17 +2,160 @@ package main
 
 // HomePageValues represents the values used in the homepage.
 type HomePageValues struct {
-	CountHelped uint
-	Error       string
+	CountHelped    uint
+	Error          string
+	Categories     []string // What students can pick from, see categories.go.
+	LabSections    []string // See Config.LabSections.
+	Locations      []string // Where students in the lab can be, see Config.Locations.
+	MeetingDomains []string // Where remote students' meetings can be.
+	Appointments   bool     // Whether there are slots students can book, see appointments.go.
+	Theme          Theme
+	Locale         string
 }
 
 // RejectedPageValues represents the values used in the queue rejected page
 type RejectedPageValues struct {
-	NumTimesJoined uint
-	Name           string
+	Limit           HelpLimit
+	CooldownMinutes uint
+	Name            string
+	Theme           Theme
+	Locale          string
 }
 
 // StatusPageValues represents the values used in the "current queue status" page.
 type StatusPageValues struct {
-	Entries []QueueEntry
+	Entries        []QueueEntry
+	Sessions       []Session   // The group sessions going on.
+	Whereabouts    Whereabouts // Where the TA looking at the panel is.
+	Categories     []string    // Every category, to filter the panel by.
+	Category       string      // The category the panel is filtered by, if any.
+	Mine           bool        // Whether the panel is filtered by the TA's categories.
+	Hidden         int         // How many waiting tickets the filter hides.
+	Helping        *QueueEntry // The ticket the TA is helping, if any.
+	NobodyNext     bool        // Whether the TA asked for the next student, but there was nobody.
+	DeferPositions uint        // See Config.DeferPositions.
+	DeferMinutes   uint
+	Theme          Theme
+	Locale         string
+}
+
+// TicketPageValues represents the values used in the page where TAs manage
+// a single ticket.
+type TicketPageValues struct {
+	Entry    QueueEntry
+	Position uint         // 1 for the front of the queue.
+	Others   []QueueEntry // The other waiting tickets, it can be merged into.
+	Error    string
+	Theme    Theme
+	Locale   string
+}
+
+// GroupPageValues represents the values used in the page where TAs pick
+// students for a group session.
+type GroupPageValues struct {
+	Entries  []QueueEntry
+	Selected map[uint]bool
+	Location string
+	Error    string
+	Theme    Theme
+	Locale   string
+}
+
+// WhereaboutsPageValues represents the values used in the page where TAs say
+// where they are.
+type WhereaboutsPageValues struct {
+	Whereabouts    Whereabouts
+	Locations      []string
+	MeetingDomains []string
+	Error          string
+	Theme          Theme
+	Locale         string
+}
+
+// CategoriesPageValues represents the values used in the page where TAs
+// subscribe to categories, and instructors edit them.
+type CategoriesPageValues struct {
+	Categories []string
+	Subscribed map[string]bool
+	Instructor bool
+	Text       string // The categories, one per line, for instructors to edit.
+	Error      string
+	Theme      Theme
+	Locale     string
+}
+
+// OrderingPageValues represents the values used in the page where
+// instructors pick how the queue is ordered.
+type OrderingPageValues struct {
+	Settings    OrderingSettings
+	LabSections []string
+	Priority    map[string]bool // Whether each lab section goes first.
+	Error       string
+	Message     string
+	Theme       Theme
+	Locale      string
+}
+
+// AppointmentsPageValues represents the values used in the page where
+// students book appointments.
+type AppointmentsPageValues struct {
+	Slots              []Slot
+	Bookings           []Booking // The student's upcoming appointments, if they booked from this browser.
+	MaxBookingsPerWeek uint
+	Emails             bool // Whether confirmations can be emailed.
+	Error              string
+	Message            string
+	Theme              Theme
+	Locale             string
+}
+
+// AvailabilityPageValues represents the values used in the page where TAs
+// publish when students can book them.
+type AvailabilityPageValues struct {
+	Blocks             []AvailabilityBlock
+	Bookings           []Booking
+	Categories         []string
+	AppointmentMinutes uint
+	Error              string
+	Message            string
+	Theme              Theme
+	Locale             string
+}
+
+// StatsPageValues represents the values used in the instructors' statistics page.
+type StatsPageValues struct {
+	Stats      Stats
+	From       string // YYYY-MM-DD, as entered in the date range form.
+	To         string // YYYY-MM-DD, inclusive.
+	MaxPerHour int    // Busiest hour of the week, used to shade the table.
+	Theme      Theme
+	Locale     string
+}
+
+// PrivacyPageValues represents the values used in the instructors' privacy page.
+type PrivacyPageValues struct {
+	RetentionDays   uint
+	RetentionAction string
+	Message         string
+	Error           string
+	Theme           Theme
+	Locale          string
+}
+
+// ThemePageValues represents the values used in the instructors' branding page.
+type ThemePageValues struct {
+	Override Theme // The instructors' override, as shown in the form.
+	Theme    Theme // The resulting theme, also used to render the page.
+	Locale   string
+	Message  string
+	Error    string
+}
+
+// BlockedPageValues represents the values used in the page listing the
+// clients that went over the rate limits.
+type BlockedPageValues struct {
+	Clients []BlockedClient
+	Message string
+	Theme   Theme
+	Locale  string
 }
@@ -2,93 +2,128 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
 )
 
+// Possible values of storeStatus.
+const (
+	StoreNotLoaded = "not loaded" // LoadDataFromDisk hasn't run yet.
+	StoreNew       = "new"        // There was no persistence.json, so we started empty.
+	StoreLoaded    = "loaded"     // persistence.json was loaded.
+	StoreCorrupted = "corrupted"  // persistence.json couldn't be parsed, so we started empty.
+)
+
+// storeStatus records how LoadDataFromDisk went, for /readyz.
+var storeStatus = StoreNotLoaded
+
 // LoadDataFromDisk fills the in-memory data structure by reading
 // the persistence.json file. To be called when booting/restarting
 // the application.
 func LoadDataFromDisk() {
 	// Restore data from disk storage before running (persistence.json).
-	jsonStore, err := ioutil.ReadFile("persistence.json")
+	jsonStore, err := ioutil.ReadFile(CurrentConfig().DataPath("persistence.json"))
 	if err != nil {
-		log.Println("Couldn't read persistence.json. Perhaps, this is the first time the application is running?")
+		slog.Info("Couldn't read persistence.json. Perhaps, this is the first time the application is running?")
+		storeStatus = StoreNew
 	} else {
+		// Unlike corrupted data, we must not overwrite data we can't decrypt
+		// with a fresh datastore: the right key might just be missing.
+		jsonStore, err = OpenStore(jsonStore)
+		if err != nil {
+			fatal("Couldn't decrypt persistence.json.", "error", err)
+		}
 		jsonErr := json.Unmarshal(jsonStore, &queue)
 		if jsonErr != nil {
-			log.Println("Couldn't unmarshal persistence.json. This is likely the result of data corruption.", jsonErr)
-			log.Println("210queue is starting with a fresh new datastore.")
+			slog.Error("Couldn't unmarshal persistence.json. This is likely the result of data corruption. 210queue is starting with a fresh new datastore.", "error", jsonErr)
+			storeStatus = StoreCorrupted
 		} else {
-			log.Println("Restarting with data from persistence.json.")
 			queue.Mutex.Lock()
+			assignTicketIDs()
 			numEntries := len(queue.Entries)
 			queue.Mutex.Unlock()
-			log.Println("Restarting with", numEntries, "entries in the queue.")
+			slog.Info("Restarting with data from persistence.json.", "entries", numEntries)
+			storeStatus = StoreLoaded
 		}
 	}
 }
 
 // UpdateDiskCopy converts the data structure to a JSON file
-// and saves it to disk. The caller of this function should
-// have locked the mutex before calling it.
-func UpdateDiskCopy() {
-	queueJSON, _ := json.Marshal(queue)
-	err := ioutil.WriteFile("persistence.json", queueJSON, 0644)
+// and saves it to disk, encrypted if a key is configured.
+// Errors are logged as well as returned.
+// The caller of this function should have locked the mutex
+// before calling it.
+func UpdateDiskCopy() error {
+	start := time.Now()
+	queueJSON, _ := json.Marshal(&queue)
+	store, err := SealStore(queueJSON)
+	if err != nil {
+		slog.Error("Couldn't encrypt persistence.json, it was not updated.", "error", err)
+		return err
+	}
+	err = writePrivateFile(CurrentConfig().DataPath("persistence.json"), store)
 	if err != nil {
-		log.Println(err)
-		return
+		slog.Error("Couldn't write persistence.json.", "error", err)
+		return err
 	}
-	log.Println("Updated persistence.json with new data.")
+	persistSeconds.Observe("", time.Since(start).Seconds())
+	slog.Debug("Updated persistence.json with new data.")
+	return nil
 }
 
-func LoadPasswordsFromDisk() map[string]string {
-	passwordsStore, err := ioutil.ReadFile("authdb.json")
+// writePrivateFile writes data to the file at path, only readable by us. It
+// writes a temporary file and renames it over path, so that the file is
+// never half-written, and files created with looser permissions by older
+// versions are replaced.
+func writePrivateFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
 	if err != nil {
-		log.Fatalln("Couldn't read authdb.json. Create it before running this application.")
+		return err
 	}
-	theMap := map[string]string{}
-	jsonErr := json.Unmarshal(passwordsStore, &theMap)
-	if jsonErr != nil {
-		log.Fatalln("I couldn't unmarshal authdb.json. The JSON syntax is probably bad.")
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
 	}
-	return theMap
+	return os.Rename(tmp.Name(), path)
 }
 
-// A type that stores the application configuration.
-type Config struct {
-	ListenAt          string
-	AuthSecret        string
-	MaxNumTimesHelped uint
+// DumpJSON returns the decrypted contents of the datastore, as it would be
+// written to persistence.json.
+func DumpJSON() []byte {
+	queue.Mutex.Lock()
+	queueJSON, _ := json.Marshal(&queue)
+	queue.Mutex.Unlock()
+	return queueJSON
 }
 
-// Reads the system configuration from the config.json file.
-func ReadConfig() Config {
-
-	config := Config{}
-	configStore, err := ioutil.ReadFile("config.json")
+// ReadTADatabase reads the usernames and passwords of the TAs from the
+// JSON file at path (authdb.json by default).
+func ReadTADatabase(path string) (map[string]string, error) {
+	passwordsStore, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalln("Couldn't read config.json. Create and fill it before running this application.")
+		return nil, fmt.Errorf("couldn't read the TA database: %v", err)
 	}
-	theMap := map[string]interface{}{}
-	jsonErr := json.Unmarshal(configStore, &theMap)
+	theMap := map[string]string{}
+	jsonErr := json.Unmarshal(passwordsStore, &theMap)
 	if jsonErr != nil {
-		log.Fatalln("I couldn't unmarshal config.json. The JSON syntax is probably bad.")
+		return nil, fmt.Errorf("couldn't unmarshal the TA database, the JSON syntax is probably bad: %v", jsonErr)
 	}
-
-	// ListenAt is the HTTP port the web-server should listen at for incoming
-	// connections.
-	config.ListenAt = theMap["ListenAt"].(string)
-
-	// AuthSecret is a random string that is used when hashing CSids and
-	// storing them in a cookie.
-	// This kind of crypto is used to ensure that only whoever joined
-	// the queue can actually leave it manually (/leaveearly).
-	config.AuthSecret = theMap["AuthSecret"].(string)
-
-	// MaxNumTimesHelped is a constant which represents the maximum number of
-	// times a student can seek help within a 24 hour timeframe.
-	config.MaxNumTimesHelped = uint(theMap["MaxNumTimesHelped"].(float64))
-
-	return config
+	if len(theMap) == 0 {
+		return nil, errors.New("the TA database is empty")
+	}
+	for user, password := range theMap {
+		if user == "" || password == "" {
+			return nil, errors.New("the TA database contains an empty username or password")
+		}
+	}
+	return theMap, nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUpdateDiskCopyPermissions(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	SetConfig(cfg)
+
+	// Older versions created persistence.json readable by everybody.
+	path := cfg.DataPath("persistence.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0644))
+	UpdateDiskCopy()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	files, err := ioutil.ReadDir(cfg.DataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestReencryptNeedsAStore(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	defer func(saved string) { storeStatus = saved }(storeStatus)
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	SetConfig(cfg)
+
+	// A missing or corrupted store must not be replaced by an empty one.
+	require.Equal(t, 1, runReencryptCommand())
+	_, err := os.Stat(cfg.DataPath("persistence.json"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, ioutil.WriteFile(cfg.DataPath("persistence.json"), []byte("{not json"), 0600))
+	require.Equal(t, 1, runReencryptCommand())
+	stored, err := ioutil.ReadFile(cfg.DataPath("persistence.json"))
+	require.NoError(t, err)
+	require.Equal(t, "{not json", string(stored))
+	require.Equal(t, 1, runExportCommand(nil))
+
+	require.NoError(t, ioutil.WriteFile(cfg.DataPath("persistence.json"), []byte("{}"), 0600))
+	require.Equal(t, 0, runReencryptCommand())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// This file contains the data retention policy, and the tools instructors
+// use to answer a student's request to see or erase their data.
+
+// Retention actions, see Config.RetentionAction.
+const (
+	RetentionAnonymise = "anonymise" // Drop name, task and contact details, and hash the CSid.
+	RetentionDelete    = "delete"    // Delete the whole ticket.
+)
+
+// ApplyRetentionPolicy anonymises or deletes (depending on
+// Config.RetentionAction) the finished tickets that were created more than
+// Config.RetentionDays days before now, and the appointments that ended
+// before then. Returns how many tickets and bookings were affected.
+func ApplyRetentionPolicy(now time.Time) int {
+	config := CurrentConfig()
+	if config.RetentionDays == 0 {
+		return 0
+	}
+	cutoff := now.AddDate(0, 0, -int(config.RetentionDays))
+	affected := 0
+	queue.Mutex.Lock()
+	kept := []QueueEntry{}
+	for _, entry := range queue.Entries {
+		expired := !entry.IsWaiting() && entry.JoinedAt.Before(cutoff)
+		if !expired || (entry.Anonymised && config.RetentionAction == RetentionAnonymise) {
+			kept = append(kept, entry)
+			continue
+		}
+		affected++
+		if config.RetentionAction == RetentionAnonymise {
+			kept = append(kept, anonymise(entry))
+		}
+	}
+	queue.Entries = kept
+	keptBookings := []Booking{}
+	for _, booking := range queue.Bookings {
+		expired := booking.End.Before(cutoff)
+		if !expired || (booking.Anonymised && config.RetentionAction == RetentionAnonymise) {
+			keptBookings = append(keptBookings, booking)
+			continue
+		}
+		affected++
+		if config.RetentionAction == RetentionAnonymise {
+			keptBookings = append(keptBookings, anonymiseBooking(booking))
+		}
+	}
+	queue.Bookings = keptBookings
+	if affected > 0 {
+		UpdateDiskCopy()
+	}
+	queue.Mutex.Unlock()
+	return affected
+}
+
+// anonymise strips everything that identifies the student from the ticket,
+// keeping only what's needed for statistics. The CSid is replaced by its
+// pseudonym, so that repeat visits can still be counted.
+func anonymise(entry QueueEntry) QueueEntry {
+	entry.CSid = Pseudonym(entry.CSid, CurrentConfig().PseudonymKey)
+	entry.Name = ""
+	entry.TaskInfo = ""
+	entry.Where.MeetingURL = ""
+	entry.Email = ""
+	entry.Push = nil
+	entry.RemovalReason = ""
+	entry.Anonymised = true
+	return entry
+}
+
+// RunRetentionPolicy applies the retention policy now, and then every hour.
+// Never returns.
+func RunRetentionPolicy() {
+	for {
+		if affected := ApplyRetentionPolicy(time.Now()); affected > 0 {
+			slog.Info("Applied the retention policy.", "action", CurrentConfig().RetentionAction, "records", affected)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// isStudentRecord returns whether entry belongs to the given CSid, including
+// tickets that were anonymised by the retention policy.
+func isStudentRecord(entry QueueEntry, CSid string) bool {
+	return belongsTo(entry.CSid, entry.Anonymised, CSid)
+}
+
+// isStudentBooking is isStudentRecord for bookings.
+func isStudentBooking(booking Booking, CSid string) bool {
+	return belongsTo(booking.CSid, booking.Anonymised, CSid)
+}
+
+// belongsTo returns whether a record about recordCSid, which is a pseudonym
+// if the record was anonymised, is about the given CSid.
+func belongsTo(recordCSid string, anonymised bool, CSid string) bool {
+	if anonymised {
+		return recordCSid == Pseudonym(CSid, CurrentConfig().PseudonymKey)
+	}
+	return recordCSid == CSid
+}
+
+// StudentRecords returns every ticket we hold about the given CSid.
+func StudentRecords(CSid string) []QueueEntry {
+	acc := []QueueEntry{}
+	queue.Mutex.Lock()
+	for _, entry := range queue.Entries {
+		if isStudentRecord(entry, CSid) {
+			acc = append(acc, entry)
+		}
+	}
+	queue.Mutex.Unlock()
+	return acc
+}
+
+// StudentBookingRecords returns every booking we hold about the given CSid.
+func StudentBookingRecords(CSid string) []Booking {
+	acc := []Booking{}
+	queue.Mutex.Lock()
+	for _, booking := range queue.Bookings {
+		if isStudentBooking(booking, CSid) {
+			acc = append(acc, booking)
+		}
+	}
+	queue.Mutex.Unlock()
+	return acc
+}
+
+// EraseStudent deletes every ticket and booking we hold about the given
+// CSid, including the ticket they might be waiting with. Returns how many
+// tickets and bookings were deleted.
+func EraseStudent(CSid string) (int, int) {
+	erased := 0
+	var waiting []QueueEntry
+	queue.Mutex.Lock()
+	kept := []QueueEntry{}
+	for _, entry := range queue.Entries {
+		if isStudentRecord(entry, CSid) {
+			erased++
+			if entry.IsWaiting() {
+				waiting = append(waiting, entry)
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	queue.Entries = kept
+	erasedBookings := 0
+	keptBookings := []Booking{}
+	for _, booking := range queue.Bookings {
+		if isStudentBooking(booking, CSid) {
+			erasedBookings++
+			continue
+		}
+		keptBookings = append(keptBookings, booking)
+	}
+	queue.Bookings = keptBookings
+	for _, entry := range waiting {
+		publishQueueEvent(EventLeft, entry)
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return erased, erasedBookings
+}
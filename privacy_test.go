@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRetentionAndErasure(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	SetConfig(Config{PseudonymKey: "key", RetentionDays: 30, RetentionAction: RetentionAnonymise})
+	now := time.Now()
+	old := now.AddDate(0, 0, -31)
+	queue.Entries = []QueueEntry{
+		{CSid: "r3a1b", Name: "Joe Student", TaskInfo: "Lost", Email: "joe@example.com",
+			JoinedAt: old, WasServed: true, ServedAt: old},
+		{CSid: "r3a2b", Name: "Diligent Student", JoinedAt: old, WasServed: true, ServedAt: old},
+		{CSid: "r3a1b", Name: "Joe Student", JoinedAt: now},
+	}
+	defer func() { queue.Entries = []QueueEntry{} }()
+
+	require.Equal(t, 2, ApplyRetentionPolicy(now))
+	require.Len(t, queue.Entries, 3)
+	require.Equal(t, Pseudonym("r3a1b", "key"), queue.Entries[0].CSid)
+	require.Empty(t, queue.Entries[0].Name)
+	require.Empty(t, queue.Entries[0].TaskInfo)
+	require.Empty(t, queue.Entries[0].Email)
+	require.True(t, queue.Entries[0].Anonymised)
+	require.Equal(t, "Joe Student", queue.Entries[2].Name)
+	require.Zero(t, ApplyRetentionPolicy(now)) // Nothing left to do.
+
+	// Both the anonymised and the current ticket belong to the student.
+	require.Len(t, StudentRecords("r3a1b"), 2)
+	erased, erasedBookings := EraseStudent("r3a1b")
+	require.Equal(t, 2, erased)
+	require.Zero(t, erasedBookings)
+	require.Len(t, queue.Entries, 1)
+	require.Empty(t, StudentRecords("r3a1b"))
+	require.False(t, HasJoinedQueue("r3a1b"))
+
+	SetConfig(Config{PseudonymKey: "key", RetentionDays: 30, RetentionAction: RetentionDelete})
+	require.Equal(t, 1, ApplyRetentionPolicy(now))
+	require.Empty(t, queue.Entries)
+}
+
+func TestIsInstructor(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	SetConfig(DefaultConfig())
+	require.False(t, IsInstructor("ta1")) // Nobody is an instructor unless listed.
+
+	cfg := DefaultConfig()
+	cfg.Instructors = []string{"instructor1"}
+	SetConfig(cfg)
+	require.True(t, IsInstructor("instructor1"))
+	require.False(t, IsInstructor("ta1"))
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// This file contains the Web Push notifier, which lets students close the
+// status page and still get a browser notification as they get close to the
+// front of the queue. Payloads are encrypted as described in RFC 8291, and
+// push requests are signed with our VAPID keys (see vapid.go).
+
+// PushSubscription is what the browser gives us when a student allows
+// notifications, in the format of PushSubscription.toJSON().
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// Validate returns an error if the subscription can't possibly be used.
+func (s *PushSubscription) Validate() error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return errors.New("the push endpoint must be an https URL")
+	}
+	if _, _, err := s.decodeKeys(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decodeKeys returns the browser's public key and authentication secret.
+func (s *PushSubscription) decodeKeys() (*ecdh.PublicKey, []byte, error) {
+	rawPublic, err := base64.RawURLEncoding.DecodeString(s.Keys.P256dh)
+	if err != nil {
+		return nil, nil, errors.New("invalid p256dh key")
+	}
+	public, err := ecdh.P256().NewPublicKey(rawPublic)
+	if err != nil {
+		return nil, nil, errors.New("invalid p256dh key")
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(s.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, errors.New("invalid auth secret")
+	}
+	return public, auth, nil
+}
+
+// The size of the single record we send. Our payloads are tiny.
+const pushRecordSize = 4096
+
+// EncryptPushPayload encrypts plaintext for the given subscription, using the
+// aes128gcm content encoding (RFC 8188 and RFC 8291).
+func EncryptPushPayload(sub *PushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublic, authSecret, err := sub.decodeKeys()
+	if err != nil {
+		return nil, err
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic.Bytes()...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, ecdhSecret), keyInfo, 32)
+	prk := hkdfExtract(salt, ikm)
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 is the padding delimiter for the last (and only) record.
+	record := append(append([]byte{}, plaintext...), 0x02)
+	if len(record)+gcm.Overhead() > pushRecordSize {
+		return nil, errors.New("push payload is too large")
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	_ = binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+// hkdfExtract and hkdfExpand implement HKDF (RFC 5869) with SHA-256. We never
+// need more than one block of output.
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// errPushSubscriptionGone is returned when the push service tells us that the
+// subscription expired or was revoked.
+var errPushSubscriptionGone = errors.New("push subscription is no longer valid")
+
+// PushMessage is the payload our service worker (static/js/push-sw.js) expects.
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// PushSender delivers push messages to push services.
+type PushSender struct {
+	Keys    *VAPIDKeys
+	Subject string // Contact URL for the push services, mailto: or https:.
+	Client  *http.Client
+}
+
+// Send encrypts msg and delivers it to the subscription.
+func (p *PushSender) Send(sub *PushSubscription, msg PushMessage) error {
+	plaintext, _ := json.Marshal(msg)
+	body, err := EncryptPushPayload(sub, plaintext)
+	if err != nil {
+		return err
+	}
+	authorization, err := p.Keys.AuthorizationHeader(sub.Endpoint, p.Subject)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", authorization)
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", "600")
+	request.Header.Set("Urgency", "high")
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return errPushSubscriptionGone
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return fmt.Errorf("push service returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// PushNotifier sends a push notification to subscribed students whenever
+// their position in the queue drops to one of the Thresholds, and when a TA
+// claims them.
+type PushNotifier struct {
+	Sender     *PushSender
+	Thresholds []uint // How many students ahead, for instance [5, 1, 0].
+
+	mutex    sync.Mutex
+	notified map[string]uint // CSid -> smallest threshold we already sent a notification for.
+}
+
+// NewPushNotifier returns a PushNotifier that uses the push settings in cfg.
+func NewPushNotifier(cfg Config, keys *VAPIDKeys) *PushNotifier {
+	return &PushNotifier{
+		Sender:     &PushSender{Keys: keys, Subject: cfg.VAPIDSubject, Client: &http.Client{Timeout: 10 * time.Second}},
+		Thresholds: cfg.PushThresholds,
+		notified:   map[string]uint{},
+	}
+}
+
+// Notify implements Notifier.
+func (n *PushNotifier) Notify(event QueueEvent) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch event.Kind {
+	case EventServed:
+		delete(n.notified, event.Entry.CSid)
+		if event.Entry.Push != nil {
+			locale := event.Entry.Locale
+			msg := PushMessage{Translate(locale, "A TA is on the way"),
+				Translate(locale, "A TA has just picked you from the queue.")}
+			if !event.Entry.Where.IsZero() || !event.Entry.TAWhere.IsZero() {
+				msg.Body = claimText(locale, event.Entry)
+			}
+			if event.Entry.SessionID != 0 {
+				msg = PushMessage{Translate(locale, "You've been pulled into a group session"),
+					groupSessionText(locale, event.Session)}
+			}
+			n.send(event.Entry, msg)
+		}
+	case EventNoShow:
+		// They'll be notified again as they come back up the queue.
+		delete(n.notified, event.Entry.CSid)
+		if event.Entry.Push != nil {
+			locale := event.Entry.Locale
+			n.send(event.Entry, PushMessage{Translate(locale, "A TA couldn't find you"),
+				Translate(locale, "Others will go ahead of you. Please head back to the lab.")})
+		}
+	case EventDropped:
+		delete(n.notified, event.Entry.CSid)
+		if event.Entry.Push != nil {
+			locale := event.Entry.Locale
+			n.send(event.Entry, PushMessage{Translate(locale, "You missed your turn"),
+				Translate(locale, "You were taken off the queue after %d no-shows.", event.Entry.NoShows)})
+		}
+	case EventLeft, EventRemoved, EventMerged, EventSnoozed:
+		delete(n.notified, event.Entry.CSid)
+	}
+	for i, entry := range event.Waiting {
+		if entry.Push == nil || entry.IsDeferred(time.Now()) {
+			continue
+		}
+		position := uint(i)
+		threshold, crossed := n.crossedThreshold(entry.CSid, position)
+		if !crossed {
+			continue
+		}
+		n.notified[entry.CSid] = threshold
+		msg := PushMessage{Translate(entry.Locale, "You're next!"),
+			Translate(entry.Locale, "Please get ready, a TA will be with you shortly.")}
+		if position == 1 {
+			msg = PushMessage{Translate(entry.Locale, "Almost your turn"),
+				Translate(entry.Locale, "There is 1 student ahead of you in the queue.")}
+		} else if position > 1 {
+			msg = PushMessage{Translate(entry.Locale, "Almost your turn"),
+				Translate(entry.Locale, "There are %d students ahead of you in the queue.", position)}
+		}
+		n.send(entry, msg)
+	}
+}
+
+// crossedThreshold returns the smallest threshold position has reached, if
+// we haven't notified the student about it yet.
+func (n *PushNotifier) crossedThreshold(CSid string, position uint) (uint, bool) {
+	best, crossed := uint(0), false
+	for _, threshold := range n.Thresholds {
+		if position <= threshold && (!crossed || threshold < best) {
+			best, crossed = threshold, true
+		}
+	}
+	if last, ok := n.notified[CSid]; crossed && ok && last <= best {
+		return 0, false
+	}
+	return best, crossed
+}
+
+// send delivers msg to the student's browser. Subscriptions that the push
+// service rejected as expired are removed from the ticket.
+func (n *PushNotifier) send(entry QueueEntry, msg PushMessage) {
+	err := n.Sender.Send(entry.Push, msg)
+	if err == errPushSubscriptionGone {
+		SetPushSubscription(entry.CSid, nil)
+	} else if err != nil {
+		slog.Warn("Couldn't send push notification.", append(ticketAttrs(entry), "error", err)...)
+	}
+}
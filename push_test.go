@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBrowser returns a subscription to endpoint, and the private key the
+// browser would use to decrypt messages.
+func newTestBrowser(t *testing.T, endpoint string) (*PushSubscription, *ecdh.PrivateKey, []byte) {
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	auth := make([]byte, 16)
+	_, _ = rand.Read(auth)
+	sub := &PushSubscription{Endpoint: endpoint}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return sub, private, auth
+}
+
+// decryptPushPayload does what the browser does with an aes128gcm body.
+func decryptPushPayload(t *testing.T, body []byte, private *ecdh.PrivateKey, auth []byte) []byte {
+	salt := body[:16]
+	require.Equal(t, uint32(pushRecordSize), binary.BigEndian.Uint32(body[16:20]))
+	idLen := int(body[20])
+	asPublic, err := ecdh.P256().NewPublicKey(body[21 : 21+idLen])
+	require.NoError(t, err)
+	secret, err := private.ECDH(asPublic)
+	require.NoError(t, err)
+	keyInfo := append([]byte("WebPush: info\x00"), private.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic.Bytes()...)
+	prk := hkdfExtract(salt, hkdfExpand(hkdfExtract(auth, secret), keyInfo, 32))
+	block, _ := aes.NewCipher(hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12), body[21+idLen:], nil)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x02), record[len(record)-1])
+	return record[:len(record)-1]
+}
+
+func TestEncryptPushPayload(t *testing.T) {
+	sub, private, auth := newTestBrowser(t, "https://push.example.com/abc")
+	require.NoError(t, sub.Validate())
+	body, err := EncryptPushPayload(sub, []byte("Hello, world!"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(decryptPushPayload(t, body, private, auth)))
+
+	sub.Endpoint = "http://localhost/internal"
+	require.Error(t, sub.Validate())
+}
+
+func TestVAPIDKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vapid.json")
+	keys, err := LoadOrGenerateVAPIDKeys(path)
+	require.NoError(t, err)
+	reloaded, err := LoadOrGenerateVAPIDKeys(path)
+	require.NoError(t, err)
+	require.Equal(t, keys.PublicKey(), reloaded.PublicKey())
+
+	header, err := keys.AuthorizationHeader("https://push.example.com/abc/def", "mailto:queue@example.com")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(header, "vapid t="))
+	require.True(t, strings.HasSuffix(header, ", k="+keys.PublicKey()))
+	token := strings.TrimSuffix(strings.TrimPrefix(header, "vapid t="), ", k="+keys.PublicKey())
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+
+	claims := map[string]interface{}{}
+	rawClaims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, json.Unmarshal(rawClaims, &claims))
+	require.Equal(t, "https://push.example.com", claims["aud"])
+	require.Equal(t, "mailto:queue@example.com", claims["sub"])
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	require.True(t, ecdsa.Verify(&keys.Private.PublicKey, digest[:], r, s))
+}
+
+func TestPushNotifierThresholds(t *testing.T) {
+	received := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	keys, err := LoadOrGenerateVAPIDKeys(filepath.Join(t.TempDir(), "vapid.json"))
+	require.NoError(t, err)
+	n := NewPushNotifier(Config{PushThresholds: []uint{2, 1, 0}}, keys)
+	sub, private, auth := newTestBrowser(t, server.URL)
+
+	others := []QueueEntry{{CSid: "r3a1b"}, {CSid: "r3a2b"}, {CSid: "r3a3b"}}
+	me := QueueEntry{CSid: "r3a4b", Push: sub}
+	expectPush := func(waiting []QueueEntry, title string, body string) {
+		n.Notify(QueueEvent{Kind: EventServed, Waiting: append(waiting, me)})
+		if title == "" {
+			select {
+			case <-received:
+				t.Fatal("Unexpected push notification")
+			case <-time.After(50 * time.Millisecond):
+			}
+			return
+		}
+		msg := PushMessage{}
+		require.NoError(t, json.Unmarshal(decryptPushPayload(t, <-received, private, auth), &msg))
+		require.Equal(t, title, msg.Title)
+		require.Equal(t, body, msg.Body)
+	}
+	expectPush(others, "", "")
+	expectPush(others[1:], "Almost your turn", "There are 2 students ahead of you in the queue.")
+	expectPush(others[2:], "Almost your turn", "There is 1 student ahead of you in the queue.")
+	expectPush(nil, "You're next!", "Please get ready, a TA will be with you shortly.")
+	expectPush(nil, "", "")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file throttles the public endpoints, so that a script can't flood the
+// queue with fake students or keep the CPU busy checking cookies. Every
+// client IP, and every student who proved their CSid with their cookie, gets
+// a token bucket for each route. CSids that anybody can type in aren't
+// limited, or one student could use up another's tokens. Clients who
+// run out of tokens are turned away with 429 Too Many Requests, and listed on
+// /admin/blocked until they can make requests again, or a TA unblocks them.
+
+// A RateLimit is a token bucket: a client can make Burst requests in a row,
+// and then PerMinute requests a minute. Requests aren't limited if PerMinute
+// is 0.
+type RateLimit struct {
+	PerMinute uint
+	Burst     uint
+}
+
+// RouteLimits are the rate limits of a route.
+type RouteLimits struct {
+	PerIP   RateLimit
+	PerCSid RateLimit // Only for routes that know which student is making the request.
+}
+
+// DefaultRateLimits returns the rate limits of every route that has them.
+// The status page asks for the student's position every 5 seconds, and a
+// whole lab can be behind the same IP, so the IP limits are generous.
+func DefaultRateLimits() map[string]RouteLimits {
+	return map[string]RouteLimits{
+		"/join":                {PerIP: RateLimit{PerMinute: 20, Burst: 10}},
+		"/status_for_id":       {PerIP: RateLimit{PerMinute: 300, Burst: 60}, PerCSid: RateLimit{PerMinute: 30, Burst: 10}},
+		"/isqueueopen":         {PerIP: RateLimit{PerMinute: 300, Burst: 60}},
+		"/leaveearly":          {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 10, Burst: 5}},
+		"/snooze":              {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 10, Burst: 5}},
+		"/pushsubscription":    {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 10, Burst: 5}},
+		"/appointments":        {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 20, Burst: 10}},
+		"/appointments/book":   {PerIP: RateLimit{PerMinute: 20, Burst: 10}, PerCSid: RateLimit{PerMinute: 10, Burst: 5}},
+		"/appointments/cancel": {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 10, Burst: 5}},
+		"/appointments/ics":    {PerIP: RateLimit{PerMinute: 60, Burst: 20}, PerCSid: RateLimit{PerMinute: 20, Burst: 10}},
+	}
+}
+
+// rateLimitedRoutes returns the routes that can be rate limited, sorted.
+func rateLimitedRoutes() []string {
+	var routes []string
+	for route := range DefaultRateLimits() {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// A BlockedClient is a client that went over a rate limit.
+type BlockedClient struct {
+	Key      string // Identifies the client's bucket, see Unblock.
+	Route    string
+	Kind     string    // "ip" or "csid".
+	Client   string    // The IP address or CSid.
+	Since    time.Time // When its first request was turned away.
+	Until    time.Time // When it can make a request again.
+	Rejected uint      // How many requests were turned away.
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A RateLimiter keeps the token buckets of every client.
+type RateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	blocked   map[string]*BlockedClient
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a RateLimiter where every bucket is full.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: map[string]*tokenBucket{}, blocked: map[string]*BlockedClient{}}
+}
+
+// The buckets of the public endpoints.
+var rateLimiter = NewRateLimiter()
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Minutes()*float64(limit.PerMinute))
+	b.last = now
+}
+
+// Take takes a token from the client's bucket for route. If there are none
+// left, returns how long until there is one, and whether this is the first
+// request from the client that was turned away.
+func (l *RateLimiter) Take(route string, kind string, client string, limit RateLimit, now time.Time) (bool, time.Duration, bool) {
+	if limit.PerMinute == 0 {
+		return true, 0, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	key := route + " " + kind + " " + client
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(limit, now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		delete(l.blocked, key)
+		return true, 0, false
+	}
+	wait := time.Duration((1 - bucket.tokens) / float64(limit.PerMinute) * float64(time.Minute))
+	blocked, found := l.blocked[key]
+	if !found {
+		blocked = &BlockedClient{Key: key, Route: route, Kind: kind, Client: client, Since: now}
+		l.blocked[key] = blocked
+	}
+	blocked.Until = now.Add(wait)
+	blocked.Rejected++
+	return false, wait, !found
+}
+
+// sweep forgets, once a minute, the clients that haven't made a request in
+// an hour, so that buckets don't pile up. With any sensible limit, their
+// buckets are full by then. Must be called with the mutex held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Hour {
+			delete(l.buckets, key)
+		}
+	}
+	for key, blocked := range l.blocked {
+		if now.After(blocked.Until) {
+			delete(l.blocked, key)
+		}
+	}
+}
+
+// Blocked returns the clients that are being turned away, oldest first.
+func (l *RateLimiter) Blocked(now time.Time) []BlockedClient {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	clients := []BlockedClient{}
+	for _, blocked := range l.blocked {
+		if now.Before(blocked.Until) {
+			clients = append(clients, *blocked)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Since.Before(clients[j].Since) })
+	return clients
+}
+
+// Unblock fills up the bucket with the given key, see BlockedClient. Returns
+// the client, if it was blocked.
+func (l *RateLimiter) Unblock(key string) (BlockedClient, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	blocked, found := l.blocked[key]
+	if !found {
+		return BlockedClient{}, false
+	}
+	delete(l.blocked, key)
+	delete(l.buckets, key)
+	return *blocked, true
+}
+
+// RateLimited turns away requests to route from clients that went over its
+// rate limits. csid returns the CSid of the student making the request, if
+// the route has one. It must only return CSids the student proved are theirs.
+func RateLimited(route string, csid func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits := CurrentConfig().RateLimits[route]
+		now := time.Now()
+		if !takeToken(c, route, "ip", ClientIP(c), limits.PerIP, now) {
+			return
+		}
+		if csid == nil {
+			return
+		}
+		if CSid := csid(c); CSid != "" {
+			takeToken(c, route, "csid", CSid, limits.PerCSid, now)
+		}
+	}
+}
+
+// takeToken takes a token for the client, or aborts the request.
+func takeToken(c *gin.Context, route string, kind string, client string, limit RateLimit, now time.Time) bool {
+	ok, wait, first := rateLimiter.Take(route, kind, client, limit, now)
+	if ok {
+		return true
+	}
+	rateLimitedTotal.Inc(metricLabels("route", route, "kind", kind))
+	if first {
+		attrs := []interface{}{"route", route, "kind", kind}
+		if kind == "ip" {
+			attrs = append(attrs, "client_ip", client)
+		}
+		RequestLogger(c).Warn("Client went over the rate limit.", attrs...)
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.String(http.StatusTooManyRequests, Translate(Locale(c), "Too many requests, please try again in %d seconds.", seconds))
+	c.Abort()
+	return false
+}
+
+// ClientIP returns the IP address of the client. The X-Forwarded-For header
+// is only used if the request comes from one of the TrustedProxies, as
+// anybody else could make it up.
+func ClientIP(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	proxies := CurrentConfig().TrustedProxies
+	if !inNetworks(net.ParseIP(host), proxies) {
+		return host
+	}
+	// Proxies append the address they got the request from, so the client
+	// is the last address that isn't one of ours.
+	forwarded := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !inNetworks(ip, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+// inNetworks returns whether ip is in one of the networks, given in CIDR
+// notation.
+func inNetworks(ip net.IP, networks []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range networks {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter()
+	limit := RateLimit{PerMinute: 60, Burst: 2}
+	now := time.Now()
+	take := func(client string) (bool, time.Duration, bool) {
+		return limiter.Take("/join", "ip", client, limit, now)
+	}
+
+	ok, _, _ := take("192.0.2.1")
+	require.True(t, ok)
+	ok, _, _ = take("192.0.2.1")
+	require.True(t, ok)
+	ok, wait, first := take("192.0.2.1")
+	require.False(t, ok)
+	require.True(t, first)
+	require.Equal(t, time.Second, wait)
+	ok, _, first = take("192.0.2.1")
+	require.False(t, ok)
+	require.False(t, first)
+	ok, _, _ = take("192.0.2.2") // Other clients have their own bucket.
+	require.True(t, ok)
+
+	blocked := limiter.Blocked(now)
+	require.Len(t, blocked, 1)
+	require.Equal(t, "192.0.2.1", blocked[0].Client)
+	require.Equal(t, uint(2), blocked[0].Rejected)
+	require.Empty(t, limiter.Blocked(now.Add(2*time.Second)))
+
+	// Tokens come back over time.
+	now = now.Add(1500 * time.Millisecond)
+	ok, _, _ = take("192.0.2.1")
+	require.True(t, ok)
+	require.Empty(t, limiter.Blocked(now))
+
+	// TAs can unblock clients right away.
+	take("192.0.2.2")
+	take("192.0.2.2")
+	ok, _, _ = take("192.0.2.2")
+	require.False(t, ok)
+	client, found := limiter.Unblock(limiter.Blocked(now)[0].Key)
+	require.True(t, found)
+	require.Equal(t, "192.0.2.2", client.Client)
+	ok, _, _ = take("192.0.2.2")
+	require.True(t, ok)
+	_, found = limiter.Unblock("/join ip 192.0.2.2")
+	require.False(t, found)
+
+	ok, _, _ = limiter.Take("/join", "ip", "192.0.2.3", RateLimit{}, now) // Not limited.
+	require.True(t, ok)
+}
+
+func TestClientIP(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	SetConfig(cfg)
+	clientIP := func(remoteAddr string, forwardedFor string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.RemoteAddr = remoteAddr
+		c.Request.Header.Set("X-Forwarded-For", forwardedFor)
+		return ClientIP(c)
+	}
+	require.Equal(t, "192.0.2.1", clientIP("192.0.2.1:1234", "198.51.100.1"))
+	require.Equal(t, "198.51.100.1", clientIP("10.0.0.1:1234", "198.51.100.1"))
+	require.Equal(t, "198.51.100.1", clientIP("10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2"))
+	require.Equal(t, "10.0.0.1", clientIP("10.0.0.1:1234", ""))
+}
+
+func TestRateLimited(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	defer func(saved *RateLimiter) { rateLimiter = saved }(rateLimiter)
+	rateLimiter = NewRateLimiter()
+	cfg := DefaultConfig()
+	cfg.AuthSecret = "secret"
+	cfg.RateLimits = map[string]RouteLimits{
+		"/status_for_id": {PerIP: RateLimit{PerMinute: 1, Burst: 4}, PerCSid: RateLimit{PerMinute: 1, Burst: 1}},
+	}
+	SetConfig(cfg)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/status_for_id", RateLimited("/status_for_id", studentCSid), func(c *gin.Context) { c.Status(http.StatusOK) })
+	poll := func(remoteAddr string, CSid string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/status_for_id", nil)
+		req.AddCookie(&http.Cookie{Name: "queue-csid", Value: CSid})
+		req.AddCookie(&http.Cookie{Name: "queue-secret", Value: secret})
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	secrets := map[string]string{}
+	for _, CSid := range []string{"a1b2c", "d3e4f"} {
+		secrets[CSid] = GenerateSecretForCSid(CSid)
+	}
+	require.Equal(t, http.StatusOK, poll("192.0.2.1:1", "a1b2c", secrets["a1b2c"]).Code)
+	w := poll("192.0.2.2:1", "a1b2c", secrets["a1b2c"]) // Same student, another IP.
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	// Checking secrets is slow on purpose, so some time may have passed.
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.True(t, retryAfter > 0 && retryAfter <= 60, retryAfter)
+
+	// Requests for a CSid without its secret don't use up the student's tokens.
+	require.Equal(t, http.StatusOK, poll("192.0.2.1:1", "d3e4f", "forged").Code)
+	require.Equal(t, http.StatusOK, poll("192.0.2.1:1", "d3e4f", "forged").Code)
+	require.Equal(t, http.StatusOK, poll("192.0.2.3:1", "d3e4f", secrets["d3e4f"]).Code)
+	require.Equal(t, http.StatusOK, poll("192.0.2.1:1", "", "").Code)
+	require.Equal(t, http.StatusTooManyRequests, poll("192.0.2.1:1", "g5h6i", "").Code)
+	require.Len(t, rateLimiter.Blocked(time.Now()), 2)
+}
+
+func TestRateLimitsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	env := map[string]string{"QUEUE_CONFIG": path, "QUEUE_AUTH_SECRET": "secret"}
+	getenv := func(key string) string { return env[key] }
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"RateLimits": {"/join": {"PerIP": {"PerMinute": 5, "Burst": 5}}}}`), 0600))
+	cfg, _, err := LoadConfig(nil, getenv)
+	require.NoError(t, err)
+	require.Equal(t, RouteLimits{PerIP: RateLimit{PerMinute: 5, Burst: 5}}, cfg.RateLimits["/join"])
+	require.Equal(t, DefaultRateLimits()["/isqueueopen"], cfg.RateLimits["/isqueueopen"])
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"RateLimits": {"/jion": {}}}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, `RateLimits: can't limit "/jion", only /appointments, /appointments/book, /appointments/cancel, /appointments/ics, /isqueueopen, /join, /leaveearly, /pushsubscription, /snooze, /status_for_id`)
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"RateLimits": {"/join": {"PerIP": {"PerMinute": 5}}}}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, "RateLimits./join: Burst must be at least 1")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"RateLimits": {"/join": {"PerCSid": {"PerMinute": 3, "Burst": 3}}}}`), 0600))
+	_, _, err = LoadConfig(nil, getenv)
+	require.EqualError(t, err, "RateLimits./join: PerCSid can't be set, the route doesn't know which student is making the request")
+}
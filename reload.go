@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// This file reloads the configuration and the TA database while the server
+// is running, on SIGHUP or when an instructor asks for it.
+
+// Settings that are only read when the server starts. Changing them is
+// reported, but only takes effect after a restart.
+var restartConfigKeys = map[string]bool{
+	"ListenAt": true, "DataDir": true, "TemplatesDir": true, "StaticDir": true, "LocalesDir": true,
+	"SMTPHost": true, "SMTPPort": true, "SMTPUsername": true, "SMTPPassword": true,
+	"SMTPFrom": true, "EmailAtPosition": true,
+	"Webhooks": true, "WebhookQueueLength": true, "WebhookLongWaitMinutes": true,
+	"VAPIDSubject": true, "PushThresholds": true,
+	"EncryptionKeyFile": true, "OldEncryptionKeyFiles": true,
+	"AuthSecret": true, "PseudonymKey": true,
+}
+
+// Settings whose values must not be logged. Webhook URLs are credentials
+// too, and LimitExemptCSids lists students with accommodations.
+var secretConfigKeys = map[string]bool{
+	"AuthSecret": true, "SMTPPassword": true, "PseudonymKey": true, "MetricsToken": true,
+	"Webhooks": true, "LimitExemptCSids": true,
+}
+
+// The TAs' usernames and passwords, see ReadTADatabase.
+var taAccounts atomic.Pointer[map[string]string]
+
+// The command-line arguments the configuration was loaded from, so that
+// flags still apply when it is reloaded.
+var configArgs []string
+
+// Reloads happen one at a time.
+var reloadMutex sync.Mutex
+
+// A ConfigChange is a setting that changed when reloading.
+type ConfigChange struct {
+	Key     string
+	Old     string
+	New     string
+	Restart bool // Whether it only takes effect after a restart.
+}
+
+// SetTAAccounts replaces the TA database in use.
+func SetTAAccounts(accounts map[string]string) {
+	taAccounts.Store(&accounts)
+}
+
+// RequireTA aborts the request unless it has the HTTP Basic credentials of a
+// TA. Unlike gin.BasicAuth, it always checks against the current TA database.
+func RequireTA(c *gin.Context) {
+	user, password, ok := c.Request.BasicAuth()
+	if ok {
+		if accounts := taAccounts.Load(); accounts != nil {
+			expected, found := (*accounts)[user]
+			if found && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+				c.Set(gin.AuthUserKey, user)
+				return
+			}
+		}
+	}
+	c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// ReloadSettings reads the configuration and the TA database again, and
+// swaps them in if they are both valid. Returns what changed.
+func ReloadSettings() ([]ConfigChange, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	cfg, _, err := LoadConfig(configArgs, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := ReadTADatabase(cfg.AuthDBFile)
+	if err != nil {
+		return nil, err
+	}
+	old := CurrentConfig()
+	changes := diffConfig(*old, cfg)
+	// Changing these mid-run would break the cookies and pseudonyms already
+	// handed out, so they keep their old values until a restart.
+	cfg.AuthSecret, cfg.PseudonymKey = old.AuthSecret, old.PseudonymKey
+	if oldAccounts := taAccounts.Load(); oldAccounts != nil {
+		changes = append(changes, diffTAAccounts(*oldAccounts, accounts)...)
+	}
+	SetConfig(cfg)
+	SetTAAccounts(accounts)
+	SetUpLogging(cfg)
+	return changes, nil
+}
+
+// diffConfig returns the settings that differ between old and new.
+func diffConfig(old Config, new Config) []ConfigChange {
+	changes := []ConfigChange{}
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		key := oldValue.Type().Field(i).Name
+		before, after := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		change := ConfigChange{Key: key, Restart: restartConfigKeys[key]}
+		if secretConfigKeys[key] {
+			change.Old, change.New = "[secret]", "[secret]"
+		} else {
+			change.Old, change.New = fmt.Sprint(before), fmt.Sprint(after)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// diffTAAccounts returns the TAs who were added or removed, or whose
+// password changed. Passwords are never included.
+func diffTAAccounts(old map[string]string, new map[string]string) []ConfigChange {
+	changes := []ConfigChange{}
+	for user, password := range new {
+		if oldPassword, found := old[user]; !found {
+			changes = append(changes, ConfigChange{Key: "TA " + strconv.Quote(user), Old: "absent", New: "added"})
+		} else if oldPassword != password {
+			changes = append(changes, ConfigChange{Key: "TA " + strconv.Quote(user), Old: "[secret]", New: "password changed"})
+		}
+	}
+	for user := range old {
+		if _, found := new[user]; !found {
+			changes = append(changes, ConfigChange{Key: "TA " + strconv.Quote(user), Old: "present", New: "removed"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// logReload logs the outcome of ReloadSettings.
+func logReload(logger *slog.Logger, changes []ConfigChange, err error) {
+	if err != nil {
+		logger.Error("Couldn't reload the configuration, keeping the current one.", "error", err)
+		return
+	}
+	for _, change := range changes {
+		if change.Restart {
+			logger.Warn("Setting changed, restart the server to apply it.", "key", change.Key, "old", change.Old, "new", change.New)
+		} else {
+			logger.Info("Setting changed.", "key", change.Key, "old", change.Old, "new", change.New)
+		}
+	}
+	logger.Info("Reloaded the configuration.", "changes", len(changes))
+}
+
+// ReloadOnSIGHUP reloads the settings whenever we get SIGHUP. Never returns.
+func ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		changes, err := ReloadSettings()
+		logReload(slog.Default(), changes, err)
+	}
+}
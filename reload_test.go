@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadSettings(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	defer func(saved *map[string]string) { taAccounts.Store(saved) }(taAccounts.Load())
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	authPath := filepath.Join(dir, "authdb.json")
+	t.Setenv("QUEUE_CONFIG", configPath)
+	t.Setenv("QUEUE_AUTHDB", authPath)
+	write := func(path string, contents string) {
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ta", RequireTA, func(c *gin.Context) { c.String(http.StatusOK, c.GetString(gin.AuthUserKey)) })
+	login := func(user string, password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ta", nil)
+		req.SetBasicAuth(user, password)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	write(configPath, `{"AuthSecret": "secret1", "MaxNumTimesHelped": 5}`)
+	write(authPath, `{"ta1": "pw1"}`)
+	_, err := ReloadSettings()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, login("ta1", "pw1"))
+	require.Equal(t, http.StatusUnauthorized, login("ta2", "pw2"))
+
+	authSecret := CurrentConfig().AuthSecret
+	write(configPath, `{"AuthSecret": "secret2", "MaxNumTimesHelped": 2, "ListenAt": "9000"}`)
+	write(authPath, `{"ta1": "pw1", "ta2": "pw2"}`)
+	changes, err := ReloadSettings()
+	require.NoError(t, err)
+	require.Contains(t, changes, ConfigChange{Key: "MaxNumTimesHelped", Old: "5", New: "2"})
+	require.Contains(t, changes, ConfigChange{Key: "ListenAt", Old: "8080", New: "9000", Restart: true})
+	require.Contains(t, changes, ConfigChange{Key: "AuthSecret", Old: "[secret]", New: "[secret]", Restart: true})
+	require.Equal(t, authSecret, CurrentConfig().AuthSecret)
+	require.Contains(t, changes, ConfigChange{Key: `TA "ta2"`, Old: "absent", New: "added"})
+	require.Equal(t, uint(2), CurrentConfig().MaxNumTimesHelped)
+	require.Equal(t, http.StatusOK, login("ta2", "pw2"))
+
+	// Webhooks and exempt students are only reported as changed.
+	write(configPath, `{"AuthSecret": "secret2", "MaxNumTimesHelped": 2, "ListenAt": "9000", "LimitExemptCSids": ["r3a1b"],
+		"Webhooks": [{"URL": "https://hooks.example.com/services/T0/B0/token", "Secret": "hooksecret"}]}`)
+	changes, err = ReloadSettings()
+	require.NoError(t, err)
+	require.Contains(t, changes, ConfigChange{Key: "Webhooks", Old: "[secret]", New: "[secret]", Restart: true})
+	require.Contains(t, changes, ConfigChange{Key: "LimitExemptCSids", Old: "[secret]", New: "[secret]"})
+	reported := fmt.Sprint(changes)
+	require.NotContains(t, reported, "hooksecret")
+	require.NotContains(t, reported, "hooks.example.com")
+	require.NotContains(t, reported, "r3a1b")
+
+	// Bad settings are rejected as a whole.
+	write(configPath, `{"AuthSecret": "secret3", "MaxNumTimesHelped": 3}`)
+	write(authPath, `{}`)
+	_, err = ReloadSettings()
+	require.Error(t, err)
+	require.Equal(t, uint(2), CurrentConfig().MaxNumTimesHelped)
+	require.Equal(t, http.StatusOK, login("ta2", "pw2"))
+}
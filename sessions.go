@@ -0,0 +1,149 @@
+package main
+
+import "time"
+
+// This file contains group help sessions, where a TA serves several students
+// with the same question at once. Each ticket served in a session is linked
+// to it with QueueEntry.SessionID.
+
+// A Session is a group help session.
+type Session struct {
+	ID        uint
+	TA        string // Username of the TA running the session.
+	Location  string // Where the students should go, for instance "table 3".
+	StartedAt time.Time
+	EndedAt   time.Time // Zero until the session ends, see EndSession.
+	Tickets   []uint    // IDs of the tickets served in the session.
+}
+
+// IsActive returns whether the session is still going on.
+func (s Session) IsActive() bool {
+	return s.EndedAt.IsZero()
+}
+
+// ServeGroup serves the waiting tickets with the given IDs together, in a
+// new session run by TA at location. Any session TA was running ends. Fails
+// unless there are at least two tickets, all still waiting, so that no
+// student is pulled in twice. Returns the new session.
+func ServeGroup(IDs []uint, TA string, location string) (Session, bool) {
+	queue.Mutex.Lock()
+	indices := []int{}
+	seen := map[uint]bool{}
+	for _, ID := range IDs {
+		i := waitingIndex(ID)
+		if i < 0 || seen[ID] {
+			queue.Mutex.Unlock()
+			return Session{}, false
+		}
+		seen[ID] = true
+		indices = append(indices, i)
+	}
+	if len(indices) < 2 {
+		queue.Mutex.Unlock()
+		return Session{}, false
+	}
+	now := time.Now()
+	endSessionsLocked(TA, now)
+	session := Session{ID: queue.NextSessionID, TA: TA, Location: location, StartedAt: now}
+	queue.NextSessionID++
+	for _, i := range indices {
+		session.Tickets = append(session.Tickets, queue.Entries[i].ID)
+	}
+	queue.Sessions = append(queue.Sessions, session)
+	for _, i := range indices {
+		queue.Entries[i].WasServed = true
+		queue.Entries[i].ServedAt = now
+		queue.Entries[i].ServedBy = TA
+		queue.Entries[i].TAWhere = queue.TAWhereabouts[TA]
+		queue.Entries[i].SessionID = session.ID
+		publishQueueEvent(EventServed, queue.Entries[i])
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+	return session, true
+}
+
+// EndSession ends the session with given ID. Returns the session, if it was
+// still going on.
+func EndSession(ID uint) (Session, bool) {
+	queue.Mutex.Lock()
+	for i, session := range queue.Sessions {
+		if session.ID == ID && session.IsActive() {
+			queue.Sessions[i].EndedAt = time.Now()
+			session = queue.Sessions[i]
+			UpdateDiskCopy()
+			queue.Mutex.Unlock()
+			return session, true
+		}
+	}
+	queue.Mutex.Unlock()
+	return Session{}, false
+}
+
+// endSessionsLocked ends the sessions TA is running, as they moved on to
+// other students.
+// The caller of this function should have locked the mutex before calling it.
+func endSessionsLocked(TA string, now time.Time) {
+	for i, session := range queue.Sessions {
+		if session.TA == TA && session.IsActive() {
+			queue.Sessions[i].EndedAt = now
+		}
+	}
+}
+
+// ActiveSessions returns the sessions that are going on, oldest first.
+func ActiveSessions() []Session {
+	queue.Mutex.Lock()
+	var acc []Session
+	for _, session := range queue.Sessions {
+		if session.IsActive() {
+			acc = append(acc, session)
+		}
+	}
+	queue.Mutex.Unlock()
+	return acc
+}
+
+// AllSessions returns a copy of every session.
+func AllSessions() []Session {
+	queue.Mutex.Lock()
+	acc := make([]Session, len(queue.Sessions))
+	copy(acc, queue.Sessions)
+	queue.Mutex.Unlock()
+	return acc
+}
+
+// StudentSession returns the session the student with given CSid was
+// pulled into, if it is still going on.
+func StudentSession(CSid string) (Session, bool) {
+	queue.Mutex.Lock()
+	for i := len(queue.Entries) - 1; i >= 0; i-- {
+		entry := queue.Entries[i]
+		if entry.CSid == CSid && entry.SessionID != 0 {
+			session, ok := sessionLocked(entry.SessionID)
+			queue.Mutex.Unlock()
+			return session, ok && session.IsActive()
+		}
+	}
+	queue.Mutex.Unlock()
+	return Session{}, false
+}
+
+// groupSessionText tells a student where to go for the session, in locale.
+func groupSessionText(locale string, session Session) string {
+	if session.Location == "" {
+		return Translate(locale, "A TA is helping a few students with the same question together. Please head back to the lab now.")
+	}
+	return Translate(locale, "A TA is helping a few students with the same question together, at %s. Please head there now.", session.Location)
+}
+
+// sessionLocked returns the session with given ID.
+// The caller of this function should have locked the mutex before calling it.
+func sessionLocked(ID uint) (Session, bool) {
+	for _, session := range queue.Sessions {
+		if session.ID == ID {
+			return session, true
+		}
+	}
+	return Session{}, false
+}
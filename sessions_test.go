@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestGroupSessions(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, sessions []Session, nextSessionID uint) {
+		queue.Entries, queue.NextID = entries, nextID
+		queue.Sessions, queue.NextSessionID = sessions, nextSessionID
+	}(queue.Entries, queue.NextID, queue.Sessions, queue.NextSessionID)
+	queue.Entries = []QueueEntry{}
+	queue.Sessions = nil
+	for _, CSid := range []string{"r3a1b", "r3a2b", "r3a3b", "r3a4b"} {
+		JoinQueue(QueueEntry{Name: "Student", CSid: CSid, TaskInfo: "Lab 2, question 3.", Locale: DefaultLocale})
+	}
+	first, second, third := queue.Entries[0].ID, queue.Entries[1].ID, queue.Entries[2].ID
+
+	_, ok := ServeGroup([]uint{first}, "ta1", "table 3")
+	require.False(t, ok, "a group needs two students")
+	_, ok = ServeGroup([]uint{first, first}, "ta1", "table 3")
+	require.False(t, ok)
+	session, ok := ServeGroup([]uint{first, third}, "ta1", "table 3")
+	require.True(t, ok)
+	require.Equal(t, []uint{first, third}, session.Tickets)
+	require.True(t, session.IsActive())
+	require.Len(t, UnservedEntries(), 2)
+	require.Equal(t, session.ID, queue.Entries[0].SessionID)
+	require.Equal(t, "ta1", queue.Entries[2].ServedBy)
+	require.Equal(t, uint(1), NumTimesHelped("r3a1b"))
+
+	// Nobody is pulled into two sessions.
+	_, ok = ServeGroup([]uint{second, third}, "ta2", "")
+	require.False(t, ok)
+	require.Len(t, UnservedEntries(), 2)
+
+	found, ok := StudentSession("r3a3b")
+	require.True(t, ok)
+	require.Equal(t, "table 3", found.Location)
+	_, ok = StudentSession("r3a2b")
+	require.False(t, ok)
+	require.Len(t, ActiveSessions(), 1)
+
+	// Serving another student ends the TA's session.
+	_, ok = ServeStudent("r3a2b", "ta1")
+	require.True(t, ok)
+	require.Empty(t, ActiveSessions())
+	_, ok = StudentSession("r3a3b")
+	require.False(t, ok)
+	_, ok = EndSession(session.ID)
+	require.False(t, ok)
+
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a5b", TaskInfo: "Lab 2, question 3.", Locale: DefaultLocale})
+	session, ok = ServeGroup([]uint{queue.Entries[3].ID, queue.Entries[4].ID}, "ta2", "")
+	require.True(t, ok)
+	ended, ok := EndSession(session.ID)
+	require.True(t, ok)
+	require.False(t, ended.IsActive())
+	require.Len(t, AllSessions(), 2)
+}
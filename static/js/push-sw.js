@@ -0,0 +1,27 @@
+// Service worker for the queue's push notifications. The server sends
+// {"title": ..., "body": ...} payloads, see PushMessage in push.go.
+
+self.addEventListener("push", function (event) {
+    let message = {title: "CPSC 210 Queue", body: "Your position in the queue has changed."};
+    if (event.data) {
+        message = event.data.json();
+    }
+    event.waitUntil(self.registration.showNotification(message.title, {
+        body: message.body,
+        tag: "queue-position",
+        renotify: true,
+        requireInteraction: true
+    }));
+});
+
+self.addEventListener("notificationclick", function (event) {
+    event.notification.close();
+    event.waitUntil(self.clients.matchAll({type: "window"}).then(function (windows) {
+        for (let i = 0; i < windows.length; i++) {
+            if (new URL(windows[i].url).pathname === "/status" && "focus" in windows[i]) {
+                return windows[i].focus();
+            }
+        }
+        return self.clients.openWindow("/status");
+    }));
+});
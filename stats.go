@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// This file computes the statistics shown to instructors on /admin/stats.
+// Everything is derived from the tickets stored in persistence.json.
+
+// We don't know when a TA finishes helping a student, so we assume they
+// helped them until they picked their next student. Gaps longer than this
+// are a TA taking a break, or the end of their shift, and are ignored.
+const maxHelpDuration = time.Hour
+
+// DayCount is the number of tickets created on a given day.
+type DayCount struct {
+	Day   string // YYYY-MM-DD
+	Count int
+}
+
+// TALoad summarises the work done by a single TA.
+type TALoad struct {
+	TA          string
+	Served      int     // Students, including those served in group sessions.
+	Sessions    int     // Group sessions.
+	HelpMinutes float64 // Estimated, see maxHelpDuration.
+}
+
+// CategoryStats summarises the tickets in a single category.
+type CategoryStats struct {
+	Category          string // Empty for tickets created without a category.
+	Tickets           int
+	Served            int
+	MedianWaitMinutes float64
+}
+
+// Stats contains the statistics for the tickets created between From and To.
+type Stats struct {
+	From                 time.Time
+	To                   time.Time
+	Tickets              int
+	TicketsPerDay        []DayCount
+	TicketsPerHourOfWeek [7][24]int // [time.Weekday][hour]
+	MedianWaitMinutes    float64
+	P90WaitMinutes       float64
+	MedianHelpMinutes    float64
+	P90HelpMinutes       float64
+	NoShowRate           float64 // Fraction of tickets where the student left, or was dropped as a no-show, before being served.
+	Removed              int     // Tickets a TA removed, or merged into another, without serving them.
+	Sessions             int     // Group sessions, see sessions.go.
+	StudentsInSessions   int     // Students served in group sessions.
+	UniqueStudentsHelped int
+	RepeatVisitors       int // Students who were helped more than once.
+	PerTA                []TALoad
+	PerCategory          []CategoryStats // Empty unless some tickets have a category, see categories.go.
+}
+
+// ComputeStats returns the statistics for the tickets in entries that were
+// created between from (inclusive) and to (exclusive). sessions are the
+// group sessions these tickets were served in.
+func ComputeStats(entries []QueueEntry, sessions []Session, from time.Time, to time.Time) Stats {
+	stats := Stats{From: from, To: to}
+	perDay := map[string]int{}
+	timesHelped := map[string]int{}
+	inSessions := map[uint]bool{}
+	var waits []time.Duration
+	perCategory := map[string]*CategoryStats{}
+	waitsPerCategory := map[string][]time.Duration{}
+	categorised := false
+	var left int
+	var finished int
+	for _, entry := range entries {
+		if entry.JoinedAt.Before(from) || !entry.JoinedAt.Before(to) {
+			continue
+		}
+		// Dropped no-shows are students who did join, unlike spam and duplicates.
+		if entry.Removed && !entry.DroppedAsNoShow {
+			stats.Removed++
+			continue
+		}
+		stats.Tickets++
+		joined := entry.JoinedAt.Local()
+		perDay[joined.Format("2006-01-02")]++
+		stats.TicketsPerHourOfWeek[joined.Weekday()][joined.Hour()]++
+		category, ok := perCategory[entry.Category]
+		if !ok {
+			category = &CategoryStats{Category: entry.Category}
+			perCategory[entry.Category] = category
+		}
+		category.Tickets++
+		categorised = categorised || entry.Category != ""
+		if entry.DroppedAsNoShow {
+			finished++
+			left++
+			continue
+		}
+		if !entry.WasServed {
+			continue
+		}
+		finished++
+		if entry.LeftEarly {
+			left++
+			continue
+		}
+		waits = append(waits, entry.ServedAt.Sub(entry.JoinedAt))
+		category.Served++
+		waitsPerCategory[entry.Category] = append(waitsPerCategory[entry.Category], entry.ServedAt.Sub(entry.JoinedAt))
+		timesHelped[entry.CSid]++
+		if entry.SessionID != 0 {
+			stats.StudentsInSessions++
+			inSessions[entry.SessionID] = true
+		}
+	}
+	stats.Sessions = len(inSessions)
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		stats.TicketsPerDay = append(stats.TicketsPerDay, DayCount{key, perDay[key]})
+	}
+	stats.MedianWaitMinutes = percentile(waits, 50).Minutes()
+	stats.P90WaitMinutes = percentile(waits, 90).Minutes()
+	if finished > 0 {
+		stats.NoShowRate = float64(left) / float64(finished)
+	}
+	stats.UniqueStudentsHelped = len(timesHelped)
+	for _, times := range timesHelped {
+		if times > 1 {
+			stats.RepeatVisitors++
+		}
+	}
+
+	if categorised {
+		for name, category := range perCategory {
+			category.MedianWaitMinutes = percentile(waitsPerCategory[name], 50).Minutes()
+			stats.PerCategory = append(stats.PerCategory, *category)
+		}
+		sort.Slice(stats.PerCategory, func(i, j int) bool {
+			if stats.PerCategory[i].Tickets != stats.PerCategory[j].Tickets {
+				return stats.PerCategory[i].Tickets > stats.PerCategory[j].Tickets
+			}
+			return stats.PerCategory[i].Category < stats.PerCategory[j].Category
+		})
+	}
+
+	helps, perTA := helpDurations(entries, sessions, from, to)
+	stats.MedianHelpMinutes = percentile(helps, 50).Minutes()
+	stats.P90HelpMinutes = percentile(helps, 90).Minutes()
+	stats.PerTA = perTA
+	return stats
+}
+
+// A service is a TA helping a student, or a group of students at once.
+type service struct {
+	start    time.Time
+	end      time.Time // Zero unless the service was a group session that was ended.
+	students int       // How many of the students were in range.
+	session  bool
+}
+
+// helpDurations estimates how long each student, or group of students, in
+// range was helped for, and how much work each TA did. See maxHelpDuration.
+func helpDurations(entries []QueueEntry, sessions []Session, from time.Time, to time.Time) ([]time.Duration, []TALoad) {
+	ends := map[uint]time.Time{}
+	for _, session := range sessions {
+		ends[session.ID] = session.EndedAt
+	}
+	servicesBy := map[string][]*service{}
+	inSession := map[uint]*service{}
+	for _, entry := range entries {
+		if !entry.WasServed || entry.LeftEarly || entry.ServedBy == "" {
+			continue
+		}
+		s, ok := inSession[entry.SessionID]
+		if !ok || entry.SessionID == 0 {
+			s = &service{start: entry.ServedAt, end: ends[entry.SessionID], session: entry.SessionID != 0}
+			servicesBy[entry.ServedBy] = append(servicesBy[entry.ServedBy], s)
+			if entry.SessionID != 0 {
+				inSession[entry.SessionID] = s
+			}
+		}
+		if !entry.JoinedAt.Before(from) && entry.JoinedAt.Before(to) {
+			s.students++
+		}
+	}
+	var helps []time.Duration
+	var perTA []TALoad
+	for TA, services := range servicesBy {
+		sort.Slice(services, func(i, j int) bool { return services[i].start.Before(services[j].start) })
+		load := TALoad{TA: TA}
+		for i, s := range services {
+			if s.students == 0 {
+				continue
+			}
+			load.Served += s.students
+			if s.session {
+				load.Sessions++
+			}
+			var help time.Duration
+			switch {
+			case !s.end.IsZero():
+				help = s.end.Sub(s.start)
+			case i+1 < len(services):
+				help = services[i+1].start.Sub(s.start)
+			default:
+				continue
+			}
+			if help <= maxHelpDuration {
+				helps = append(helps, help)
+				load.HelpMinutes += help.Minutes()
+			}
+		}
+		if load.Served > 0 {
+			perTA = append(perTA, load)
+		}
+	}
+	sort.Slice(perTA, func(i, j int) bool { return perTA[i].Served > perTA[j].Served })
+	return helps, perTA
+}
+
+// percentile returns the p-th percentile of durations, using the
+// nearest-rank method. Returns 0 if durations is empty.
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestComputeStats(t *testing.T) {
+	day := time.Date(2019, time.March, 4, 0, 0, 0, 0, time.Local) // A Monday.
+	at := func(hour int, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	entries := []QueueEntry{
+		{CSid: "r3a1b", JoinedAt: at(10, 0), WasServed: true, ServedAt: at(10, 10), ServedBy: "ta1", Category: "Lab 5"},
+		{CSid: "r3a2b", JoinedAt: at(10, 5), WasServed: true, ServedAt: at(10, 25), ServedBy: "ta1"},
+		{CSid: "r3a3b", JoinedAt: at(10, 6), WasServed: true, ServedAt: at(10, 36), ServedBy: "ta2", Category: "Lab 5"},
+		{CSid: "r3a1b", JoinedAt: at(11, 0), WasServed: true, ServedAt: at(11, 40), ServedBy: "ta1", Category: "Exam review"},
+		{CSid: "r3a4b", JoinedAt: at(11, 1), WasServed: true, ServedAt: at(11, 2), LeftEarly: true},
+		{CSid: "r3a5b", JoinedAt: at(11, 30)},
+		{CSid: "r3a7b", JoinedAt: at(11, 31), Removed: true, RemovedAt: at(11, 32), RemovedBy: "ta2"},
+		{CSid: "r3a8b", JoinedAt: at(11, 33), Removed: true, RemovedAt: at(11, 50), DroppedAsNoShow: true, NoShows: 3},
+		{CSid: "r3a6b", JoinedAt: day.AddDate(0, 0, -1)}, // Out of range.
+	}
+	stats := ComputeStats(entries, nil, day, day.AddDate(0, 0, 2))
+
+	require.Equal(t, 7, stats.Tickets) // Removed tickets aren't counted.
+	require.Equal(t, []DayCount{{"2019-03-04", 7}, {"2019-03-05", 0}}, stats.TicketsPerDay)
+	require.Equal(t, 3, stats.TicketsPerHourOfWeek[time.Monday][10])
+	require.Equal(t, 4, stats.TicketsPerHourOfWeek[time.Monday][11])
+	// Waits are 10, 20, 30 and 40 minutes.
+	require.Equal(t, 20.0, stats.MedianWaitMinutes)
+	require.Equal(t, 40.0, stats.P90WaitMinutes)
+	// One student left, and another was dropped, out of six.
+	require.Equal(t, 2.0/6, stats.NoShowRate)
+	require.Equal(t, 1, stats.Removed)
+	require.Equal(t, 3, stats.UniqueStudentsHelped)
+	require.Equal(t, 1, stats.RepeatVisitors)
+	// ta1 helped r3a1b for 15 minutes, then r3a2b until their next student
+	// 75 minutes later, which is too long to count.
+	require.Equal(t, 15.0, stats.MedianHelpMinutes)
+	require.Equal(t, []TALoad{{"ta1", 3, 0, 15}, {"ta2", 1, 0, 0}}, stats.PerTA)
+	require.Equal(t, []CategoryStats{{"", 4, 1, 20}, {"Lab 5", 2, 2, 10}, {"Exam review", 1, 1, 40}}, stats.PerCategory)
+}
+
+func TestComputeStatsSessions(t *testing.T) {
+	day := time.Date(2019, time.March, 4, 10, 0, 0, 0, time.Local)
+	at := func(minute int) time.Time { return day.Add(time.Duration(minute) * time.Minute) }
+	sessions := []Session{{ID: 1, TA: "ta1", StartedAt: at(10), EndedAt: at(25), Tickets: []uint{1, 2, 3}}}
+	entries := []QueueEntry{
+		{CSid: "r3a1b", JoinedAt: at(0), WasServed: true, ServedAt: at(10), ServedBy: "ta1", SessionID: 1},
+		{CSid: "r3a2b", JoinedAt: at(1), WasServed: true, ServedAt: at(10), ServedBy: "ta1", SessionID: 1},
+		{CSid: "r3a3b", JoinedAt: at(2), WasServed: true, ServedAt: at(10), ServedBy: "ta1", SessionID: 1},
+		{CSid: "r3a4b", JoinedAt: at(3), WasServed: true, ServedAt: at(30), ServedBy: "ta1"},
+		{CSid: "r3a5b", JoinedAt: at(4), WasServed: true, ServedAt: at(35), ServedBy: "ta1"},
+	}
+	stats := ComputeStats(entries, sessions, day, day.AddDate(0, 0, 1))
+
+	require.Equal(t, 1, stats.Sessions)
+	require.Equal(t, 3, stats.StudentsInSessions)
+	require.Equal(t, 5, stats.UniqueStudentsHelped)
+	// The session lasted 15 minutes, and counts as a single help.
+	require.Equal(t, []TALoad{{"ta1", 5, 1, 20}}, stats.PerTA)
+	require.Equal(t, 15.0, stats.P90HelpMinutes)
+}
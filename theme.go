@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// This file contains the branding of the web interface, so that courses
+// other than CPSC 210 can use the app. The theme comes from Config.Theme,
+// and instructors can override it for each queue from /admin/theme. Their
+// overrides are kept in theme.json, in the data directory.
+
+// A Theme holds the course-specific parts of the web interface. Everything
+// is plain text: HTML is escaped.
+type Theme struct {
+	CourseName       string // Shown in the title and navigation bar, e.g. "CPSC 210".
+	NavbarColour     string // Background of the navigation bar, as #rrggbb.
+	AccentColour     string // Background of the main buttons, as #rrggbb.
+	LogoURL          string // Shown next to the course name, if set.
+	Announcement     string // Shown at the top of every page, if set.
+	JoinHelpText     string // Shown below the form to join the queue.
+	RejectionMessage string // Shown to students turned away for a help limit.
+	ForumURL         string // Linked from the rejection page, if set.
+}
+
+// DefaultTheme returns the theme used for anything that isn't configured.
+// Its messages are in the catalogues, so they are translated like the rest
+// of the interface.
+func DefaultTheme() Theme {
+	return Theme{
+		CourseName:   "CPSC 210",
+		NavbarColour: "#343a40",
+		AccentColour: "#007bff",
+		JoinHelpText: "Please describe what you need help with, so that the TA can prepare.",
+		RejectionMessage: "If you still require additional assistance, you can open a new thread with your " +
+			"question on the course discussion forum, drop by the lab at a later time, or attend the " +
+			"office hours offered by your instructor.",
+		ForumURL: "https://cs210discourse.ugrad.cs.ubc.ca",
+	}
+}
+
+var themeColour = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Validate checks that colours and URLs are well-formed. Empty fields are
+// fine, as they fall back to another theme.
+func (theme Theme) Validate() error {
+	for key, colour := range map[string]string{"NavbarColour": theme.NavbarColour, "AccentColour": theme.AccentColour} {
+		if colour != "" && !themeColour.MatchString(colour) {
+			return &ConfigError{key, fmt.Errorf("expected a colour like #1a2b3c, got %q", colour)}
+		}
+	}
+	for key, url := range map[string]string{"LogoURL": theme.LogoURL, "ForumURL": theme.ForumURL} {
+		if url != "" && !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "/static/") {
+			return &ConfigError{key, fmt.Errorf("expected an https:// or /static/ URL, got %q", url)}
+		}
+	}
+	return nil
+}
+
+// Override returns theme, with the fields set in override replacing its own.
+func (theme Theme) Override(override Theme) Theme {
+	value, overrideValue := reflect.ValueOf(&theme).Elem(), reflect.ValueOf(override)
+	for i := 0; i < value.NumField(); i++ {
+		if field := overrideValue.Field(i).String(); field != "" {
+			value.Field(i).SetString(field)
+		}
+	}
+	return theme
+}
+
+// The instructors' overrides, by queue ID.
+var themeOverrides = map[string]Theme{}
+var themeMutex sync.Mutex
+
+// CurrentTheme returns the theme of the given queue.
+func CurrentTheme(queueID string) Theme {
+	themeMutex.Lock()
+	override := themeOverrides[queueID]
+	themeMutex.Unlock()
+	return CurrentConfig().Theme.Override(override)
+}
+
+// ThemeOverride returns the instructors' override for the given queue.
+func ThemeOverride(queueID string) Theme {
+	themeMutex.Lock()
+	defer themeMutex.Unlock()
+	return themeOverrides[queueID]
+}
+
+// LoadThemeOverrides reads the instructors' overrides from theme.json.
+func LoadThemeOverrides() error {
+	store, err := ioutil.ReadFile(CurrentConfig().DataPath("theme.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	overrides := map[string]Theme{}
+	if err := json.Unmarshal(store, &overrides); err != nil {
+		return err
+	}
+	themeMutex.Lock()
+	themeOverrides = overrides
+	themeMutex.Unlock()
+	return nil
+}
+
+// SetThemeOverride replaces the instructors' override for the given queue,
+// and saves it to theme.json.
+func SetThemeOverride(queueID string, override Theme) error {
+	if err := override.Validate(); err != nil {
+		return err
+	}
+	themeMutex.Lock()
+	defer themeMutex.Unlock()
+	overrides := map[string]Theme{}
+	for id, theme := range themeOverrides {
+		overrides[id] = theme
+	}
+	overrides[queueID] = override
+	store, _ := json.MarshalIndent(overrides, "", "  ")
+	if err := writePrivateFile(CurrentConfig().DataPath("theme.json"), store); err != nil {
+		return err
+	}
+	themeOverrides = overrides
+	return nil
+}
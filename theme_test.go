@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestThemeOverride(t *testing.T) {
+	theme := DefaultTheme().Override(Theme{CourseName: "CPSC 110", Announcement: "No labs this week."})
+	require.Equal(t, "CPSC 110", theme.CourseName)
+	require.Equal(t, "No labs this week.", theme.Announcement)
+	require.Equal(t, DefaultTheme().NavbarColour, theme.NavbarColour)
+	require.Equal(t, DefaultTheme().RejectionMessage, theme.RejectionMessage)
+}
+
+func TestThemeValidate(t *testing.T) {
+	require.NoError(t, DefaultTheme().Validate())
+	require.NoError(t, Theme{LogoURL: "/static/images/logo.png"}.Validate())
+	require.EqualError(t, Theme{AccentColour: "red"}.Validate(), `AccentColour: expected a colour like #1a2b3c, got "red"`)
+	require.EqualError(t, Theme{ForumURL: "javascript:alert(1)"}.Validate(),
+		`ForumURL: expected an https:// or /static/ URL, got "javascript:alert(1)"`)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"Theme": {"NavbarColour": "blue"}}`), 0600))
+	env := map[string]string{"QUEUE_CONFIG": path, "QUEUE_AUTH_SECRET": "secret"}
+	_, _, err := LoadConfig(nil, func(key string) string { return env[key] })
+	require.EqualError(t, err, `Theme.NavbarColour: expected a colour like #1a2b3c, got "blue"`)
+
+	// Fields missing from the file keep their defaults.
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"Theme": {"CourseName": "CPSC 110"}}`), 0600))
+	cfg, _, err := LoadConfig(nil, func(key string) string { return env[key] })
+	require.NoError(t, err)
+	require.Equal(t, "CPSC 110", cfg.Theme.CourseName)
+	require.Equal(t, DefaultTheme().ForumURL, cfg.Theme.ForumURL)
+}
+
+func TestSetThemeOverride(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	defer func(saved map[string]Theme) { themeOverrides = saved }(themeOverrides)
+	cfg := DefaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Theme.CourseName = "CPSC 110"
+	SetConfig(cfg)
+
+	require.Error(t, SetThemeOverride(DefaultQueueID, Theme{NavbarColour: "#12345"}))
+	require.Equal(t, "CPSC 110", CurrentTheme(DefaultQueueID).CourseName)
+
+	require.NoError(t, SetThemeOverride(DefaultQueueID, Theme{CourseName: "CPSC 210", Announcement: "Lab 3 is due."}))
+	require.Equal(t, "CPSC 210", CurrentTheme(DefaultQueueID).CourseName)
+	require.Equal(t, "CPSC 110", CurrentTheme("other").CourseName)
+
+	// The overrides survive a restart.
+	themeOverrides = map[string]Theme{}
+	require.NoError(t, LoadThemeOverrides())
+	require.Equal(t, Theme{CourseName: "CPSC 210", Announcement: "Lab 3 is due."}, ThemeOverride(DefaultQueueID))
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
 // IsValidCSid returns true if the given string contains a valid
 // username used at UBC CS.
 func IsValidCSid(id string) bool {
@@ -7,3 +12,44 @@ func IsValidCSid(id string) bool {
 	// valid usernames now.
 	return true
 }
+
+// ParseDateRange parses a range of days given as YYYY-MM-DD strings, both
+// inclusive, in the server's time zone. It returns the range as [from, to).
+// Empty strings are replaced with defaultFrom and defaultTo respectively.
+func ParseDateRange(fromParam string, toParam string, defaultFrom time.Time, defaultTo time.Time) (time.Time, time.Time, error) {
+	from, to := defaultFrom, defaultTo
+	var err error
+	if fromParam != "" {
+		if from, err = time.ParseInLocation("2006-01-02", fromParam, time.Local); err != nil {
+			return from, to, errors.New("invalid start date, expected YYYY-MM-DD")
+		}
+	}
+	if toParam != "" {
+		if to, err = time.ParseInLocation("2006-01-02", toParam, time.Local); err != nil {
+			return from, to, errors.New("invalid end date, expected YYYY-MM-DD")
+		}
+	}
+	to = to.AddDate(0, 0, 1)
+	if !from.Before(to) {
+		return from, to, errors.New("the start date must not be after the end date")
+	}
+	return from, to, nil
+}
+
+// Today returns midnight of the current day, in the server's time zone.
+func Today() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// IsInstructor returns true if the given TA username is allowed to perform
+// instructor-only actions. If no instructors are configured, no TA is.
+func IsInstructor(user string) bool {
+	config := CurrentConfig()
+	for _, instructor := range config.Instructors {
+		if instructor == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+)
+
+// This file contains the VAPID (RFC 8292) keys and signer, which identify
+// our server to the browser vendors' push services. See push.go for the
+// rest of the Web Push implementation.
+
+// VAPIDKeys is the ECDSA P-256 key pair used to sign push requests.
+type VAPIDKeys struct {
+	Private *ecdsa.PrivateKey
+}
+
+// vapidKeysFile is the on-disk format of VAPIDKeys.
+type vapidKeysFile struct {
+	PrivateKey []byte // PKCS #8, DER-encoded.
+}
+
+// LoadOrGenerateVAPIDKeys reads the key pair from path. If the file doesn't
+// exist yet, it generates a new key pair and saves it there.
+// The keys must not change once students have subscribed, as browsers tie
+// their subscriptions to our public key.
+func LoadOrGenerateVAPIDKeys(path string) (*VAPIDKeys, error) {
+	store, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		slog.Info("Couldn't find VAPID keys, generating new ones.", "path", path)
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		contents, _ := json.Marshal(vapidKeysFile{der})
+		return &VAPIDKeys{private}, ioutil.WriteFile(path, contents, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	file := vapidKeysFile{}
+	if err := json.Unmarshal(store, &file); err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(file.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(*ecdsa.PrivateKey)
+	if !ok || private.Curve != elliptic.P256() {
+		return nil, errors.New("the VAPID key must be an ECDSA P-256 key")
+	}
+	return &VAPIDKeys{private}, nil
+}
+
+// PublicKey returns the uncompressed public key, base64url-encoded. This is
+// the applicationServerKey browsers need to subscribe.
+func (k *VAPIDKeys) PublicKey() string {
+	public, _ := k.Private.PublicKey.ECDH()
+	return base64.RawURLEncoding.EncodeToString(public.Bytes())
+}
+
+// AuthorizationHeader returns the value of the Authorization header for a push
+// request to endpoint. subject is a mailto: or https: URL the push service can
+// use to contact us.
+func (k *VAPIDKeys) AuthorizationHeader(endpoint string, subject string) (string, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": endpointURL.Scheme + "://" + endpointURL.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.Private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants the raw 64 byte r || s signature, not the ASN.1 one.
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + k.PublicKey(), nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// This file contains the outgoing webhooks, which post to a chat channel
+// (Slack, Discord, Teams...) or any other HTTP endpoint when something
+// noteworthy happens to the queue.
+
+// Names of the alerts a webhook can subscribe to.
+const (
+	AlertOpen      = "open"       // The queue was opened.
+	AlertClose     = "close"      // The queue was closed.
+	AlertLongQueue = "long_queue" // The queue got longer than WebhookQueueLength.
+	AlertLongWait  = "long_wait"  // A student has been waiting for more than WebhookLongWaitMinutes.
+)
+
+// WebhookConfig describes a single outgoing webhook, as found in config.json.
+type WebhookConfig struct {
+	URL      string
+	Secret   string   // If set, payloads are signed with HMAC-SHA256 in the X-Queue-Signature header.
+	Format   string   // "slack", "discord" or "json". Teams understands "slack" bodies.
+	Template string   // Optional text/template for the body, overrides Format.
+	Alerts   []string // Which alerts to send. Empty means all of them.
+}
+
+// WebhookPayload is the data every webhook body is built from.
+type WebhookPayload struct {
+	Alert       string    `json:"alert"`
+	Message     string    `json:"message"`
+	QueueLength int       `json:"queue_length"`
+	Time        time.Time `json:"time"`
+}
+
+// Bodies for the built-in formats. Custom templates have access to the same
+// values and functions.
+var webhookFormats = map[string]string{
+	"slack":   `{"text": {{json .Message}}}`,
+	"discord": `{"content": {{json .Message}}}`,
+	"json":    `{{json .}}`,
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	},
+}
+
+// A WebhookDeadLetter records a delivery that failed even after retrying.
+type WebhookDeadLetter struct {
+	URL      string
+	Body     string
+	Error    string
+	Attempts int
+	FailedAt time.Time
+}
+
+// WebhookNotifier turns queue events into alerts, and delivers them to
+// every webhook that subscribed to them.
+type WebhookNotifier struct {
+	Hooks          []WebhookConfig
+	QueueLength    int           // Alert when the queue reaches this many students.
+	LongWait       time.Duration // Alert when somebody has been waiting for longer than this.
+	MaxAttempts    int           // Deliveries are retried up to this many times...
+	Backoff        time.Duration // ...waiting Backoff, then twice as long, and so on.
+	DeadLetterPath string        // Failed deliveries are appended to this file.
+	Client         *http.Client
+
+	mutex         sync.Mutex
+	templates     []*template.Template // One per hook.
+	longQueue     bool                 // Whether we already alerted about the current long queue.
+	alertedWaits  map[string]bool      // CSids we already alerted about.
+	deadLetterMux sync.Mutex
+}
+
+// NewWebhookNotifier returns a WebhookNotifier for the webhooks in cfg.
+// Returns an error if one of the templates doesn't parse.
+func NewWebhookNotifier(cfg Config) (*WebhookNotifier, error) {
+	n := &WebhookNotifier{
+		Hooks:          cfg.Webhooks,
+		QueueLength:    int(cfg.WebhookQueueLength),
+		LongWait:       time.Duration(cfg.WebhookLongWaitMinutes) * time.Minute,
+		MaxAttempts:    5,
+		Backoff:        2 * time.Second,
+		DeadLetterPath: cfg.DataPath("webhook_deadletters.json"),
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		alertedWaits:   map[string]bool{},
+	}
+	for _, hook := range cfg.Webhooks {
+		text := hook.Template
+		if text == "" {
+			format, ok := webhookFormats[hook.Format]
+			if !ok {
+				format = webhookFormats["json"]
+			}
+			text = format
+		}
+		tmpl, err := template.New(hook.URL).Funcs(webhookFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad template for webhook %s: %v", hook.URL, err)
+		}
+		n.templates = append(n.templates, tmpl)
+	}
+	return n, nil
+}
+
+// Notify implements Notifier.
+func (n *WebhookNotifier) Notify(event QueueEvent) {
+	switch event.Kind {
+	case EventOpened:
+		n.alert(AlertOpen, "The queue is now open.", len(event.Waiting))
+	case EventClosed:
+		n.alert(AlertClose, "The queue is now closed.", len(event.Waiting))
+	}
+	n.mutex.Lock()
+	length := len(event.Waiting)
+	crossed := length >= n.QueueLength && !n.longQueue
+	n.longQueue = length >= n.QueueLength
+	n.mutex.Unlock()
+	if crossed {
+		n.alert(AlertLongQueue, fmt.Sprintf("There are %d students waiting in the queue.", length), length)
+	}
+	n.checkWaitTimes(event.Waiting)
+}
+
+// WatchWaitTimes checks every minute whether somebody has been waiting for
+// too long, as nothing might happen to the queue for a while. Never returns.
+func (n *WebhookNotifier) WatchWaitTimes() {
+	for range time.Tick(time.Minute) {
+		n.checkWaitTimes(UnservedEntries())
+	}
+}
+
+// checkWaitTimes sends an alert for each student in waiting that has been
+// waiting for longer than LongWait. Each student is only reported once.
+func (n *WebhookNotifier) checkWaitTimes(waiting []QueueEntry) {
+	n.mutex.Lock()
+	stillWaiting := map[string]bool{}
+	var overdue []QueueEntry
+	for _, entry := range waiting {
+		stillWaiting[entry.CSid] = true
+		if time.Since(entry.JoinedAt) > n.LongWait && !n.alertedWaits[entry.CSid] {
+			n.alertedWaits[entry.CSid] = true
+			overdue = append(overdue, entry)
+		}
+	}
+	for CSid := range n.alertedWaits {
+		if !stillWaiting[CSid] {
+			delete(n.alertedWaits, CSid)
+		}
+	}
+	n.mutex.Unlock()
+	for _, entry := range overdue {
+		minutes := int(time.Since(entry.JoinedAt).Minutes())
+		n.alert(AlertLongWait, fmt.Sprintf("A student has been waiting for %d minutes.", minutes), len(waiting))
+	}
+}
+
+// alert renders the payload for every hook that wants this alert, and
+// delivers it in the background.
+func (n *WebhookNotifier) alert(alert string, message string, queueLength int) {
+	payload := WebhookPayload{Alert: alert, Message: message, QueueLength: queueLength, Time: time.Now()}
+	for i, hook := range n.Hooks {
+		if !hook.wants(alert) {
+			continue
+		}
+		var body bytes.Buffer
+		if err := n.templates[i].Execute(&body, payload); err != nil {
+			slog.Error("Couldn't render webhook body.", "url", hook.URL, "error", err)
+			continue
+		}
+		go n.deliver(hook, body.Bytes())
+	}
+}
+
+// wants returns whether the hook subscribed to the given alert.
+func (hook WebhookConfig) wants(alert string) bool {
+	if len(hook.Alerts) == 0 {
+		return true
+	}
+	for _, a := range hook.Alerts {
+		if a == alert {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver POSTs body to the hook, retrying with exponential backoff.
+// If every attempt fails, the delivery is recorded in the dead letter file.
+func (n *WebhookNotifier) deliver(hook WebhookConfig, body []byte) {
+	backoff := n.Backoff
+	var err error
+	for attempt := 1; attempt <= n.MaxAttempts; attempt++ {
+		if err = n.post(hook, body); err == nil {
+			return
+		}
+		slog.Warn("Webhook delivery failed.", "url", hook.URL, "attempt", attempt, "max_attempts", n.MaxAttempts, "error", err)
+		if attempt < n.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	n.recordDeadLetter(WebhookDeadLetter{
+		URL:      hook.URL,
+		Body:     string(body),
+		Error:    err.Error(),
+		Attempts: n.MaxAttempts,
+		FailedAt: time.Now(),
+	})
+}
+
+func (n *WebhookNotifier) post(hook WebhookConfig, body []byte) error {
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		request.Header.Set("X-Queue-Signature", "sha256="+SignWebhookBody(hook.Secret, body))
+	}
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhookBody returns the hex-encoded HMAC-SHA256 of body. Receivers can
+// compute the same value to check that a request really came from us.
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordDeadLetter appends the failed delivery to the dead letter file,
+// one JSON object per line.
+func (n *WebhookNotifier) recordDeadLetter(letter WebhookDeadLetter) {
+	n.deadLetterMux.Lock()
+	defer n.deadLetterMux.Unlock()
+	line, _ := json.Marshal(letter)
+	file, err := os.OpenFile(n.DeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Couldn't record failed webhook delivery.", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.Error("Couldn't record failed webhook delivery.", "error", err)
+	}
+}
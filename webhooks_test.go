@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	Body      string
+	Signature string
+}
+
+// startWebhookReceiver returns a server that fails the first failures
+// requests, then records every request it gets.
+func startWebhookReceiver(t *testing.T, failures int) (*httptest.Server, <-chan receivedWebhook) {
+	received := make(chan receivedWebhook, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- receivedWebhook{string(body), r.Header.Get("X-Queue-Signature")}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func newTestWebhookNotifier(t *testing.T, hooks ...WebhookConfig) *WebhookNotifier {
+	n, err := NewWebhookNotifier(Config{Webhooks: hooks, WebhookQueueLength: 2, WebhookLongWaitMinutes: 30})
+	require.NoError(t, err)
+	n.Backoff = time.Millisecond
+	n.MaxAttempts = 3
+	n.DeadLetterPath = filepath.Join(t.TempDir(), "deadletters.json")
+	return n
+}
+
+func receiveWebhook(t *testing.T, received <-chan receivedWebhook) receivedWebhook {
+	select {
+	case hook := <-received:
+		return hook
+	case <-time.After(5 * time.Second):
+		t.Fatal("No webhook was received")
+		return receivedWebhook{}
+	}
+}
+
+func TestWebhookSlackFormatAndSignature(t *testing.T) {
+	server, received := startWebhookReceiver(t, 1)
+	n := newTestWebhookNotifier(t, WebhookConfig{URL: server.URL, Secret: "s3cret", Format: "slack"})
+	n.Notify(QueueEvent{Kind: EventOpened})
+	hook := receiveWebhook(t, received)
+	require.JSONEq(t, `{"text": "The queue is now open."}`, hook.Body)
+	require.Equal(t, "sha256="+SignWebhookBody("s3cret", []byte(hook.Body)), hook.Signature)
+}
+
+func TestWebhookAlerts(t *testing.T) {
+	server, received := startWebhookReceiver(t, 0)
+	n := newTestWebhookNotifier(t, WebhookConfig{URL: server.URL, Alerts: []string{AlertLongQueue, AlertLongWait}})
+	old := QueueEntry{CSid: "r3a1b", JoinedAt: time.Now().Add(-45 * time.Minute)}
+	recent := QueueEntry{CSid: "r3a2b", JoinedAt: time.Now()}
+
+	n.Notify(QueueEvent{Kind: EventOpened}) // Not subscribed.
+	n.Notify(QueueEvent{Kind: EventJoined, Entry: old, Waiting: []QueueEntry{old}})
+	var payload WebhookPayload
+	require.NoError(t, json.Unmarshal([]byte(receiveWebhook(t, received).Body), &payload))
+	require.Equal(t, AlertLongWait, payload.Alert)
+	require.Equal(t, "A student has been waiting for 45 minutes.", payload.Message)
+
+	// The long wait was already reported, only the queue length is new.
+	n.Notify(QueueEvent{Kind: EventJoined, Entry: recent, Waiting: []QueueEntry{old, recent}})
+	require.NoError(t, json.Unmarshal([]byte(receiveWebhook(t, received).Body), &payload))
+	require.Equal(t, AlertLongQueue, payload.Alert)
+	require.Equal(t, 2, payload.QueueLength)
+	select {
+	case hook := <-received:
+		t.Fatal("Unexpected webhook:", hook.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	server, _ := startWebhookReceiver(t, 100)
+	n := newTestWebhookNotifier(t)
+	n.deliver(WebhookConfig{URL: server.URL}, []byte(`{"alert": "open"}`))
+	contents, err := ioutil.ReadFile(n.DeadLetterPath)
+	require.NoError(t, err)
+	var letter WebhookDeadLetter
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(contents))), &letter))
+	require.Equal(t, server.URL, letter.URL)
+	require.Equal(t, 3, letter.Attempts)
+	require.Equal(t, `{"alert": "open"}`, letter.Body)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file contains where students and TAs are: at a room or table in the
+// lab, from Config.Locations, or in a video meeting on one of
+// Config.MeetingDomains.
+
+// Whereabouts is where a student or a TA can be found.
+type Whereabouts struct {
+	Location   string // One of Config.Locations, if in person.
+	MeetingURL string // Link to a video meeting, if remote.
+}
+
+// IsZero returns whether nothing is known about where they are.
+func (w Whereabouts) IsZero() bool {
+	return w.Location == "" && w.MeetingURL == ""
+}
+
+// How long after being served students are shown where their TA is, unless
+// the TA serves somebody else first.
+const maxClaimDuration = time.Hour
+
+// IsValidLocation returns whether location is one of Config.Locations.
+func IsValidLocation(location string) bool {
+	for _, l := range CurrentConfig().Locations {
+		if l == location {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidMeetingURL returns whether rawURL is an https link to a video
+// meeting on one of Config.MeetingDomains, or on one of their subdomains.
+func IsValidMeetingURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range CurrentConfig().MeetingDomains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTAWhereabouts records where TA is. Students they serve from now on are
+// told so.
+func SetTAWhereabouts(TA string, where Whereabouts) {
+	queue.Mutex.Lock()
+	if queue.TAWhereabouts == nil {
+		queue.TAWhereabouts = map[string]Whereabouts{}
+	}
+	if where.IsZero() {
+		delete(queue.TAWhereabouts, TA)
+	} else {
+		queue.TAWhereabouts[TA] = where
+	}
+	UpdateDiskCopy()
+	queue.Mutex.Unlock()
+}
+
+// TAWhereabouts returns where TA said they are.
+func TAWhereabouts(TA string) Whereabouts {
+	queue.Mutex.Lock()
+	where := queue.TAWhereabouts[TA]
+	queue.Mutex.Unlock()
+	return where
+}
+
+// StudentClaim returns the ticket of the student with given CSid if a TA
+// served it on their own and is still helping them, that is, the TA served
+// it less than maxClaimDuration ago and hasn't served anybody else since.
+func StudentClaim(CSid string, now time.Time) (QueueEntry, bool) {
+	queue.Mutex.Lock()
+	defer queue.Mutex.Unlock()
+	latest := -1
+	for i, entry := range queue.Entries {
+		if entry.CSid == CSid {
+			latest = i
+		}
+	}
+	if latest < 0 {
+		return QueueEntry{}, false
+	}
+	claimed := queue.Entries[latest]
+	if !claimed.WasServed || claimed.LeftEarly || claimed.SessionID != 0 ||
+		now.Sub(claimed.ServedAt) > maxClaimDuration {
+		return QueueEntry{}, false
+	}
+	for _, entry := range queue.Entries {
+		if entry.WasServed && entry.ServedBy == claimed.ServedBy && entry.ServedAt.After(claimed.ServedAt) {
+			return QueueEntry{}, false
+		}
+	}
+	return claimed, true
+}
+
+// claimText tells the student of entry, who was just served, where to find
+// their TA, in locale.
+func claimText(locale string, entry QueueEntry) string {
+	if entry.Where.MeetingURL != "" {
+		return Translate(locale, "Your TA is joining your meeting now.")
+	}
+	if meetingURL := claimMeetingURL(entry); meetingURL != "" {
+		return Translate(locale, "Your TA is ready for you. Please join their meeting: %s", meetingURL)
+	}
+	if entry.TAWhere.Location != "" {
+		return Translate(locale, "Your TA is on their way. You can also find them at %s.", entry.TAWhere.Location)
+	}
+	return Translate(locale, "A TA has just picked you from the queue. Please head back to the lab now.")
+}
+
+// claimMeetingURL returns the link to the meeting of the TA who served entry,
+// if the student should join it. Students in the lab are sent to the TA's
+// location instead, if they have one.
+func claimMeetingURL(entry QueueEntry) string {
+	if entry.Where.MeetingURL != "" || (entry.Where.Location != "" && entry.TAWhere.Location != "") {
+		return ""
+	}
+	return entry.TAWhere.MeetingURL
+}
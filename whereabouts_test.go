@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWhereabouts(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	cfg := DefaultConfig()
+	cfg.Locations = []string{"Table 1", "Table 2"}
+	cfg.MeetingDomains = []string{"zoom.us", "meet.google.com"}
+	SetConfig(cfg)
+
+	require.True(t, IsValidLocation("Table 2"))
+	require.False(t, IsValidLocation("Table 3"))
+	require.True(t, IsValidMeetingURL("https://ubc.zoom.us/j/123"))
+	require.True(t, IsValidMeetingURL("https://meet.google.com/abc-defg-hij"))
+	require.False(t, IsValidMeetingURL("http://zoom.us/j/123"))
+	require.False(t, IsValidMeetingURL("https://zoom.us.example.com/j/123"))
+	require.False(t, IsValidMeetingURL("https://notzoom.us/j/123"))
+	require.False(t, IsValidMeetingURL("javascript:alert(1)"))
+
+	entry := QueueEntry{TAWhere: Whereabouts{Location: "Table 1", MeetingURL: "https://zoom.us/j/1"}}
+	require.Equal(t, "Your TA is ready for you. Please join their meeting: https://zoom.us/j/1", claimText(DefaultLocale, entry))
+	entry.Where.Location = "Table 2" // Students in the lab are sent to the TA's table.
+	require.Equal(t, "Your TA is on their way. You can also find them at Table 1.", claimText(DefaultLocale, entry))
+	require.Empty(t, claimMeetingURL(entry))
+	entry.Where = Whereabouts{MeetingURL: "https://zoom.us/j/2"}
+	require.Equal(t, "Your TA is joining your meeting now.", claimText(DefaultLocale, entry))
+}
+
+func TestStudentClaim(t *testing.T) {
+	defer func(entries []QueueEntry, nextID uint, whereabouts map[string]Whereabouts) {
+		queue.Entries, queue.NextID, queue.TAWhereabouts = entries, nextID, whereabouts
+	}(queue.Entries, queue.NextID, queue.TAWhereabouts)
+	queue.Entries = []QueueEntry{}
+	queue.TAWhereabouts = nil
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a1b", TaskInfo: "Lost.", Where: Whereabouts{Location: "Table 2"}, Locale: DefaultLocale})
+	JoinQueue(QueueEntry{Name: "Student", CSid: "r3a2b", TaskInfo: "Lost.", Locale: DefaultLocale})
+	SetTAWhereabouts("ta1", Whereabouts{Location: "Table 1"})
+
+	entry, found := ServeStudent("r3a1b", "ta1")
+	require.True(t, found)
+	require.Equal(t, Whereabouts{Location: "Table 1"}, entry.TAWhere)
+	claimed, ok := StudentClaim("r3a1b", time.Now())
+	require.True(t, ok)
+	require.Equal(t, "Table 2", claimed.Where.Location)
+	_, ok = StudentClaim("r3a1b", time.Now().Add(2*time.Hour))
+	require.False(t, ok)
+	_, ok = StudentClaim("r3a2b", time.Now()) // Still waiting.
+	require.False(t, ok)
+
+	// The claim is over once the TA serves somebody else.
+	time.Sleep(time.Millisecond)
+	ServeStudent("r3a2b", "ta1")
+	_, ok = StudentClaim("r3a1b", time.Now())
+	require.False(t, ok)
+	_, ok = StudentClaim("r3a2b", time.Now())
+	require.True(t, ok)
+
+	SetTAWhereabouts("ta1", Whereabouts{})
+	require.True(t, TAWhereabouts("ta1").IsZero())
+}